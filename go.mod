@@ -3,7 +3,13 @@ module github.com/raboof/beats-output-http
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.5
+	github.com/antonmedv/expr v1.9.0
 	github.com/elastic/beats/v7 v7.10.1
+	github.com/gorilla/websocket v1.5.0
+	github.com/spiffe/go-spiffe/v2 v2.1.7
+	golang.org/x/time v0.3.0
+	google.golang.org/protobuf v1.31.0
 )
 
 // needed because elastic wants these replacements, and https://github.com/golang/go/issues/30354#issuecomment-466479708
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"context"
+	"time"
+
+	libbackoff "github.com/elastic/beats/v7/libbeat/common/backoff"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+// withBackoff wraps client to wait after failed connects and publishes.
+// outputs.WithBackoff resets the delay after every successful publish, so
+// full throughput resumes immediately once the endpoint recovers. With
+// reset_on_success disabled the delay is only reset after backoff.max
+// passed without failures, which keeps pressure low on a flapping endpoint.
+func withBackoff(client outputs.NetworkClient, config backoff) outputs.NetworkClient {
+	if config.ResetOnSuccess {
+		return outputs.WithBackoff(client, config.Init, config.Max)
+	}
+	done := make(chan struct{})
+	return &backoffClient{
+		client:  client,
+		config:  config,
+		done:    done,
+		backoff: libbackoff.NewEqualJitterBackoff(done, config.Init, config.Max),
+	}
+}
+
+type backoffClient struct {
+	client      outputs.NetworkClient
+	config      backoff
+	done        chan struct{}
+	backoff     libbackoff.Backoff
+	lastFailure time.Time
+}
+
+func (b *backoffClient) Connect() error {
+	err := b.client.Connect()
+	b.wait(err)
+	return err
+}
+
+func (b *backoffClient) Close() error {
+	err := b.client.Close()
+	close(b.done)
+	b.done = make(chan struct{})
+	b.backoff = libbackoff.NewEqualJitterBackoff(b.done, b.config.Init, b.config.Max)
+	return err
+}
+
+func (b *backoffClient) Publish(ctx context.Context, batch publisher.Batch) error {
+	err := b.client.Publish(ctx, batch)
+	if err != nil {
+		b.client.Close()
+	}
+	b.wait(err)
+	return err
+}
+
+func (b *backoffClient) String() string {
+	return "backoff(" + b.client.String() + ")"
+}
+
+func (b *backoffClient) wait(err error) {
+	if err != nil {
+		b.lastFailure = time.Now()
+		b.backoff.Wait()
+		return
+	}
+	if time.Since(b.lastFailure) >= b.config.Max {
+		b.backoff.Reset()
+	}
+}
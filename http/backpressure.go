@@ -0,0 +1,68 @@
+package http
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// backpressureActive is 1 while the queue_depth or latency threshold is
+// exceeded, it is published as boolean output.http.backpressure_active.
+var backpressureActive int32
+
+func init() {
+	expvar.Publish("output.http.backpressure_active", expvar.Func(func() interface{} {
+		return atomic.LoadInt32(&backpressureActive) == 1
+	}))
+}
+
+type pressureConfig struct {
+	// QueueDepth is the number of events waiting to be published by all
+	// clients above which backpressure is signaled.
+	QueueDepth int64 `config:"queue_depth"`
+	// Latency is the time a batch takes to publish, including the wait for
+	// a connection slot or the rate limit, above which backpressure is
+	// signaled until a batch is published faster again.
+	Latency time.Duration `config:"latency"`
+}
+
+// backpressure is shared by all clients of an output and flips
+// backpressureActive when one of its thresholds is exceeded.
+type backpressure struct {
+	queueDepth int64
+	latency    time.Duration
+	slow       int32
+}
+
+func newBackpressure(c pressureConfig) *backpressure {
+	return &backpressure{queueDepth: c.QueueDepth, latency: c.Latency}
+}
+
+// observe records the latency of a batch, if it was published.
+func (b *backpressure) observe(took time.Duration) {
+	if b.latency <= 0 {
+		return
+	}
+	slow := int32(0)
+	if took > b.latency {
+		slow = 1
+	}
+	atomic.StoreInt32(&b.slow, slow)
+}
+
+// update signals backpressure if the current queue depth or the latency of
+// the last batch exceed their thresholds, and logs when that changes.
+func (b *backpressure) update() {
+	active := int32(0)
+	if b.queueDepth > 0 && queueDepth.Value() > b.queueDepth || atomic.LoadInt32(&b.slow) == 1 {
+		active = 1
+	}
+	if atomic.SwapInt32(&backpressureActive, active) == active {
+		return
+	}
+	if active == 1 {
+		logger.Warnf("Backpressure active, %d events waiting to be published.", queueDepth.Value())
+	} else {
+		logger.Infof("Backpressure no longer active.")
+	}
+}
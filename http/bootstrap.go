@@ -0,0 +1,87 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+type bootstrapConfig struct {
+	// Path is requested with Method and Body on connect, ResponseField of
+	// the JSON response is then sent in RequestHeader of all requests.
+	Path          string `config:"path"`
+	Method        string `config:"method"`
+	Body          string `config:"body"`
+	ResponseField string `config:"response_field"`
+	RequestHeader string `config:"request_header"`
+}
+
+// bootstrap holds the session of APIs that need a "begin session" call
+// before events can be posted. The session is renewed on each connect.
+type bootstrap struct {
+	config bootstrapConfig
+
+	mu      sync.Mutex
+	session string
+}
+
+func newBootstrap(c bootstrapConfig) *bootstrap {
+	return &bootstrap{config: c}
+}
+
+// apply sets the request header to the current session, if any.
+func (b *bootstrap) apply(header http.Header) {
+	b.mu.Lock()
+	session := b.session
+	b.mu.Unlock()
+	if session != "" {
+		header.Set(b.config.RequestHeader, session)
+	}
+}
+
+// runBootstrap sends the bootstrap request and keeps the session it
+// returned.
+func (client *Client) runBootstrap() error {
+	b := client.session
+	b.mu.Lock()
+	b.session = ""
+	b.mu.Unlock()
+
+	urlStr := addToURL(joinURLPath(client.URL, b.config.Path), client.params)
+	var body io.Reader
+	if b.config.Body != "" {
+		body = strings.NewReader(b.config.Body)
+	}
+	req, err := http.NewRequest(b.config.Method, urlStr, body)
+	if err != nil {
+		return fmt.Errorf("failed to create bootstrap request: %w", err)
+	}
+	client.addHeaders(req, client.headers)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := client.addBearerToken(req.Header); err != nil {
+		return err
+	}
+	_, obj, err := client.roundTrip(req)
+	if err != nil {
+		return fmt.Errorf("bootstrap request to %s failed: %w", urlStr, err)
+	}
+	var doc mapstr.M
+	if err := json.Unmarshal(obj, &doc); err != nil {
+		return fmt.Errorf("failed to decode bootstrap response: %w", err)
+	}
+	value, err := doc.GetValue(b.config.ResponseField)
+	if err != nil {
+		return fmt.Errorf("bootstrap response has no %s", b.config.ResponseField)
+	}
+	b.mu.Lock()
+	b.session = fmt.Sprint(value)
+	b.mu.Unlock()
+	return nil
+}
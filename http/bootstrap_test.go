@@ -0,0 +1,40 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+)
+
+func bootstrapDoer() *fakeDoer {
+	return &fakeDoer{respond: func(req *http.Request) (*http.Response, error) {
+		// like http.Client, a canceled request fails
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		if req.URL.Path == "/ingest/session" {
+			return response(http.StatusOK, `{"session":"s1"}`), nil
+		}
+		return response(http.StatusOK, "{}"), nil
+	}}
+}
+
+var testBootstrap = bootstrapConfig{
+	Path:          "/session",
+	Method:        "POST",
+	ResponseField: "session",
+	RequestHeader: "X-Session",
+}
+
+func TestBootstrapAfterAbort(t *testing.T) {
+	doer := bootstrapDoer()
+	client := newTestClient(t, ClientSettings{Bootstrap: testBootstrap}, doer)
+	client.abortRequests()
+	client.Close()
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("reconnect after abort: %v", err)
+	}
+	if got := doer.count(); got != 2 {
+		t.Fatalf("sent %d bootstrap requests, want 2", got)
+	}
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// responseCapture extracts a field from the JSON response to a published
+// event, such as an id assigned by the server, and logs it or appends it to
+// a file, one JSON document per line, together with the event's id.
+type responseCapture struct {
+	field   string
+	idField string
+
+	mu   sync.Mutex
+	path string
+}
+
+type captureEntry struct {
+	Timestamp time.Time   `json:"@timestamp"`
+	EventID   interface{} `json:"event_id,omitempty"`
+	Field     string      `json:"field"`
+	Value     interface{} `json:"value"`
+}
+
+func newResponseCapture(field, idField, path string) *responseCapture {
+	return &responseCapture{field: field, idField: idField, path: path}
+}
+
+// record captures the configured field of body, the response to event.
+// Responses without the field are ignored, as the event was published
+// anyway.
+func (c *responseCapture) record(event *beat.Event, body []byte) {
+	var doc mapstr.M
+	if err := json.Unmarshal(body, &doc); err != nil {
+		logger.Debugf("Not capturing response, it is not a JSON object: %v", err)
+		return
+	}
+	value, err := doc.GetValue(c.field)
+	if err != nil {
+		logger.Debugf("Not capturing response, field %s is missing", c.field)
+		return
+	}
+	var id interface{}
+	if c.idField != "" {
+		id, _ = event.GetValue(c.idField)
+	}
+	if c.path == "" {
+		logger.Infof("Captured response %s=%v for event %s=%v", c.field, value, c.idField, id)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logger.Errorf("Failed to open response capture file: %v", err)
+		return
+	}
+	defer closing(f)
+	entry := captureEntry{
+		Timestamp: time.Now().UTC(),
+		EventID:   id,
+		Field:     c.field,
+		Value:     value,
+	}
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		logger.Errorf("Failed to write captured response: %v", err)
+	}
+}
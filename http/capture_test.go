@@ -0,0 +1,48 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureResponseField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captured.ndjson")
+	bodies := []string{`{"result":{"id":"abc"}}`, `{"result":{}}`, `not json`}
+	doer := &fakeDoer{}
+	doer.respond = func(*http.Request) (*http.Response, error) {
+		body := bodies[0]
+		bodies = bodies[1:]
+		return response(http.StatusOK, body), nil
+	}
+	s := ClientSettings{CaptureField: "result.id", CaptureIDField: "message", CapturePath: path}
+	client := newTestClient(t, s, doer)
+
+	batch := &fakeBatch{events: testEvents(3)}
+	if err := client.Publish(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if !batch.acked {
+		t.Fatal("batch not acked")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// responses without the field are not captured
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("captured %d responses, want 1: %s", len(lines), data)
+	}
+	var entry captureEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.EventID != "event 0" || entry.Field != "result.id" || entry.Value != "abc" {
+		t.Errorf("captured %+v", entry)
+	}
+}
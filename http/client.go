@@ -1,54 +1,314 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/outputs"
 	"github.com/elastic/beats/v7/libbeat/outputs/outil"
 	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/elastic-agent-libs/logp"
 	"github.com/elastic/elastic-agent-libs/mapstr"
 	"github.com/elastic/elastic-agent-libs/transport"
 	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // Client struct
 type Client struct {
 	Connection
-	tlsConfig *tlscommon.TLSConfig
-	params    map[string]string
+	// settings the client was created with, clones are created from them
+	settings ClientSettings
+	svids    x509svid.Source
+	params   url.Values
 	// additional configs
-	compressionLevel int
-	proxyURL         *url.URL
+	timeout          time.Duration
 	batchPublish     bool
 	observer         outputs.Observer
 	headers          map[string]string
 	format           string
+	framing          batchFraming
+	dedupField       string
+	coalesceFields   []string
+	coalesceSum      string
+	dedupCheckURL    string
+	maxEventAge      time.Duration
+	retryBudget      time.Duration
+	maxHosts         int
+	maxRetries       int
+	dropAfterMax     bool
+	batchSizeHeader  string
+	batchIDHeader    string
+	requestIDField   string
+	requestIDHeader  string
+	requestIDGen     bool
+	addFields        mapstr.M
+	renameFields     []renameField
+	coerceFields     []coerceField
+	coerceDrop       bool
+	scriptDrop       bool
+	decimalNumbers   bool
+	maskFields       []string
+	maskMode         string
+	flatten          bool
+	flattenSep       string
+	indexArrays      bool
+	retryOnStatus    []int
+	dropOnStatus     []int
+	keepalive        *keepalive
+	healthCheck      *keepalive
+	onFailure        string
+	deadLetter       *deadLetterWriter
+	method           string
+	methodField      string
+	methodMap        map[string]string
+	sampleRate       float64
+	sampleField      string
+	concurrency      int
+	bodyField        string
+	onNonObject      string
+	nonObjectField   string
+	contentTypeField string
+	capture          *responseCapture
+	acceptedField    string
+	rejectedField    string
+	rejectedRetries  int
+	dataStreamPath   bool
+	pathTemplate     *pathTemplate
+	clusterField     string
+	clusterMap       map[string]string
+	clusterMissing   string
+	maxPending       time.Duration
+	flushInterval    time.Duration
+	shutdownTimeout  time.Duration
+	held             *heldBatches
+	ws               *wsStream
+	health           *hostHealth
+	limiter          *rate.Limiter
+	drops            *dropSummary
+	backpressure     *backpressure
+	script           *transformScript
 }
 
 // ClientSettings struct
 type ClientSettings struct {
-	URL                string
-	Proxy              *url.URL
-	TLS                *tlscommon.TLSConfig
+	URL   string
+	Proxy *url.URL
+	TLS   *tlscommon.TLSConfig
+	// TLSSource is the configuration TLS was loaded from. It is reloaded
+	// every TLSReload if its certificate authorities change.
+	TLSSource *tlscommon.Config
+	TLSReload time.Duration
+	// SVIDSource provides rotating client certificates from SPIFFE.
+	SVIDSource x509svid.Source
+	// ServerName overrides the host name used for SNI and verification.
+	ServerName string
+	// CertFingerprints pin the server's leaf certificate by SHA-256.
+	CertFingerprints   []string
+	SessionTickets     *bool
+	HandshakeTimeout   time.Duration
 	Username, Password string
-	Parameters         map[string]string
+	Parameters         url.Values
 	Index              outil.Selector
 	Pipeline           *outil.Selector
 	Timeout            time.Duration
+	ContextTimeout     bool
 	CompressionLevel   int
-	Observer           outputs.Observer
-	BatchPublish       bool
-	Headers            map[string]string
-	ContentType        string
-	Format             string
+	// NoCompressTypes lists content types that are sent uncompressed.
+	NoCompressTypes []string
+	// CompressionFlush flushes the compressed body after every event.
+	CompressionFlush bool
+	Observer         outputs.Observer
+	BatchPublish     bool
+	Headers          map[string]string
+	ContentType      string
+	Format           string
+	// ProtoMessage is the message events are encoded as in protobuf format.
+	ProtoMessage    protoreflect.MessageDescriptor
+	BatchPrefix     string
+	BatchSeparator  string
+	BatchSuffix     string
+	BatchCountField string
+	// JSONIndent pretty-prints JSON bodies with this indentation.
+	JSONIndent string
+	// GroupSize is the number of events per line in format ndjson_grouped.
+	GroupSize       int
+	SigningCommand  string
+	SigningArgs     []string
+	SigningHeader   string
+	SigningTTL      time.Duration
+	SigningTimeout  time.Duration
+	DedupField      string
+	CoalesceFields  []string
+	CoalesceSum     string
+	DedupCheckURL   string
+	MaxEventAge     time.Duration
+	RetryBudget     time.Duration
+	MaxHosts        int
+	MaxRetries      int
+	DropAfterMax    bool
+	BatchSizeHeader string
+	BatchIDHeader   string
+	RequestIDField  string
+	RequestIDHeader string
+	RequestIDGen    bool
+	AddFields       mapstr.M
+	RenameFields    []renameField
+	CoerceFields    []coerceField
+	CoerceDrop      bool
+	ScriptDrop      bool
+	// DecimalNumbers encodes floating point values in decimal notation.
+	DecimalNumbers  bool
+	MaskFields      []string
+	MaskMode        string
+	Flatten         bool
+	FlattenSep      string
+	IndexArrays     bool
+	RetryOnStatus   []int
+	DropOnStatus    []int
+	SuccessOnStatus []int
+	KeepaliveEvery  time.Duration
+	KeepaliveMethod string
+	KeepalivePath   string
+	HealthEvery     time.Duration
+	HealthMethod    string
+	HealthPath      string
+	HealthEmptyBody bool
+	OnFailure       string
+	DeadLetterPath  string
+	Method          string
+	MethodField     string
+	MethodMap       map[string]string
+	SampleRate      float64 // 0 disables sampling
+	SampleField     string
+	Concurrency     int
+	BodyField       string
+	// OnNonObject is applied to BodyField values that are not a JSON
+	// object: "send_as_is", "wrap" in an object under NonObjectField, or
+	// "drop".
+	OnNonObject    string
+	NonObjectField string
+	// ContentTypeField names the event field holding the Content-Type of
+	// the event's request.
+	ContentTypeField string
+	// CaptureField is extracted from the JSON response to each event and
+	// logged, or appended to CapturePath, with the event's CaptureIDField.
+	CaptureField   string
+	CaptureIDField string
+	CapturePath    string
+	// LogFailureFields are added to the log message when an event fails.
+	LogFailureFields []string
+	ProxyProtocol    bool
+	// Resolve maps host names to the addresses to connect to instead.
+	Resolve map[string]string
+	// NoKeepAlives disables connection reuse between requests.
+	NoKeepAlives   bool
+	DataStreamPath bool
+	// DynamicPath is appended to URL with %{[field]} references replaced by
+	// event values, or PathMissing if the field is missing.
+	DynamicPath   string
+	PathMissing   string
+	PathLowercase bool
+	// ClusterField names the event field whose value selects the base URL
+	// from ClusterMap. Events naming an unknown cluster are sent to URL or,
+	// if ClusterMissing is "drop", dropped.
+	ClusterField     string
+	ClusterMap       map[string]string
+	ClusterMissing   string
+	TrailerStatus    string
+	TrailerSuccess   []string
+	TETrailers       bool
+	StreamMarker     string
+	StreamSuccess    []string
+	AcceptedField    string
+	RejectedField    string
+	RejectedRetries  int
+	BatchHistograms  bool
+	MaxPending       time.Duration
+	MinBatchSize     int
+	FlushInterval    time.Duration
+	ShutdownTimeout  time.Duration
+	RetryOnEOF       bool
+	Prewarm          bool
+	PrettyBody       bool
+	RequestDelay     time.Duration
+	SlowRequest      time.Duration
+	TransferEncoding string
+	ChunkThreshold   int
+	WarnBodyBytes    int
+	WarnBodyRaw      bool
+	TrailingNewline  bool
+	ContentMD5       bool
+	// HTTP10 marks requests as HTTP/1.0 and closes the connection after
+	// each of them. Go's transport still writes HTTP/1.1 on the request
+	// line, but never keep-alive or chunked requests.
+	HTTP10 bool
+	// Doer sends the requests. If nil, an http.Client configured by these
+	// settings is used, tests can set it to a fake.
+	Doer Doer
+	// ShareTransport makes clones send their requests with this client's
+	// http.Client, so they share its connection pool.
+	ShareTransport bool
+	// StatefulHeader replays a value of each response in a header of the
+	// next request.
+	StatefulHeader statefulConfig
+	// Bootstrap is requested on connect, to open the session that is sent
+	// with all following requests.
+	Bootstrap bootstrapConfig
+	// health is shared by all clients of an output when events are to be
+	// dropped once all hosts are down.
+	health *hostHealth
+	// limiter is shared by all clients of an output to cap the total
+	// number of events sent per second.
+	limiter *rate.Limiter
+	// drops logs a rate-limited summary of the events dropped by all clients.
+	drops *dropSummary
+	// jwt mints the bearer tokens of all clients.
+	jwt *jwtSigner
+	// oauth2 fetches the bearer tokens of all clients.
+	oauth2 *oauth2Source
+	// connSlots is shared by all clients of a host to cap the number of
+	// requests in flight.
+	connSlots chan struct{}
+	// guard restricts the addresses connections are made to.
+	guard *addressGuard
+	// fanoutHost is set for the clients of the hosts of a fanout, which
+	// leave reporting the outcome of batches to the fanout.
+	fanoutHost bool
+	// backpressure signals when publishing falls behind.
+	backpressure *backpressure
+	// script is the compiled transform_script.
+	script *transformScript
+	// credentials replace Username and Password by the contents of files.
+	credentials *fileCredentials
+}
+
+// Doer sends HTTP requests, *http.Client implements it.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
 }
 
 // Connection struct
@@ -56,14 +316,76 @@ type Connection struct {
 	URL         string
 	Username    string
 	Password    string
-	http        *http.Client
-	connected   bool
+	http        Doer
+	connected   int32 // see isConnected
 	encoder     bodyEncoder
 	ContentType string
+	// encoders is used instead of encoder when requests run concurrently
+	encoders *sync.Pool
+	// credentials replace Username and Password if read from files
+	credentials *fileCredentials
+	// jwt is set when requests carry a JWT bearer token
+	jwt *jwtSigner
+	// oauth2 is set when requests carry an OAuth2 access token
+	oauth2 *oauth2Source
+	// connSlots holds a token per request in flight to the host, if limited
+	connSlots chan struct{}
+	// state carries a value from each response to the next request
+	state *statefulHeader
+	// session is opened by the bootstrap request on connect
+	session *bootstrap
+	// plainEncoders don't compress, they are used for content types
+	// listed in noCompress
+	plainEncoders *sync.Pool
+	noCompress    []string
+	signer        *commandSigner
+	// response trailer carrying the final request status, if any
+	trailerStatus  string
+	trailerSuccess []string
+	teTrailers     bool
+	streamMarker   string
+	streamSuccess  []string
+	successStatus  []int
+	histograms     bool
+	retryOnEOF     bool
+	prewarm        bool
+	prettyBody     bool
+	slowRequest    time.Duration
+	pacer          *pacer
+	// transferEncoding is "identity", "chunked" or "auto", which streams
+	// bodies larger than chunkThreshold chunked
+	transferEncoding string
+	chunkThreshold   int
+	http10           bool
+	// streamBatches sends compressed batches while they are encoded
+	streamBatches bool
+	logFields     []string
+	// warnBodyBytes is the body size above which a warning is logged,
+	// measured before compression if warnBodyRaw is set
+	warnBodyBytes int
+	warnBodyRaw   bool
+	// trailingNewline ends raw bodies with a newline, JSON bodies always
+	// end with one and the batch framing adds it to batches
+	trailingNewline bool
+	requestTimeout  time.Duration
+	contentMD5      bool
+
+	// requests are sent with ctx until abortRequests cancels it, the next
+	// Connect starts a new one
+	ctxMu sync.Mutex
+	ctx   context.Context
+	abort context.CancelFunc
 }
 
 type eventRaw map[string]json.RawMessage
 
+// rawBody is sent as request body without JSON encoding.
+type rawBody []byte
+
+func (b rawBody) String() string {
+	return string(b)
+}
+
 type event struct {
 	Timestamp time.Time `json:"@timestamp"`
 	Fields    mapstr.M  `json:"-"`
@@ -75,60 +397,267 @@ func NewClient(s ClientSettings) (*Client, error) {
 	if s.Proxy != nil {
 		proxy = http.ProxyURL(s.Proxy)
 	}
+	if s.guard != nil {
+		// the guard would only see the address of the proxy
+		proxy = nil
+	}
 	logger.Info("HTTP URL: %s", s.URL)
 	var dialer, tlsDialer transport.Dialer
-	var err error
 
 	dialer = transport.NetDialer(s.Timeout)
-	tlsDialer = transport.TLSDialer(dialer, s.TLS, s.Timeout)
+	if len(s.Resolve) > 0 {
+		dialer = resolvingDialer(dialer, s.Resolve)
+	}
+	if s.guard != nil {
+		dialer = guardedDialer(dialer, s.guard)
+	}
+	if s.ProxyProtocol {
+		dialer = proxyProtocolDialer(dialer)
+	}
+	// the TLS dialer's timeout bounds the handshake, the transport's
+	// TLSHandshakeTimeout is ignored when DialTLS is set
+	handshakeTimeout := s.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = s.Timeout
+	}
+	tlsOptions := tlsDialOptions{s.ServerName, s.SVIDSource, s.CertFingerprints, s.SessionTickets}
+	if tlsOptions.isSet() {
+		tlsDialer = customTLSDialer(dialer, s.TLS, handshakeTimeout, tlsOptions)
+	} else if s.TLSSource != nil && s.TLSReload > 0 {
+		tlsDialer = newReloadingTLSDialer(dialer, s.TLSSource, s.TLS, handshakeTimeout, s.TLSReload)
+	} else {
+		tlsDialer = transport.TLSDialer(dialer, s.TLS, handshakeTimeout)
+	}
 
 	if st := s.Observer; st != nil {
 		dialer = transport.StatsDialer(dialer, st)
 		tlsDialer = transport.StatsDialer(tlsDialer, st)
 	}
+	var ws *wsStream
+	if isWebSocketURL(s.URL) {
+		ws = newWSStream(s.URL, dialer, tlsDialer, proxy, s.Timeout)
+	}
 	params := s.Parameters
-	var encoder bodyEncoder
+	framing := batchFraming{Prefix: s.BatchPrefix, Separator: s.BatchSeparator, Suffix: s.BatchSuffix, CountField: s.BatchCountField}
+	if framing == (batchFraming{CountField: s.BatchCountField}) {
+		framing = defaultBatchFraming(s.Format)
+		framing.CountField = s.BatchCountField
+	}
+	framing.Indent = s.JSONIndent
+	framing.GroupSize = s.GroupSize
 	compression := s.CompressionLevel
-	if compression == 0 {
-		switch s.Format {
-		case "json":
-			encoder = newJSONEncoder(nil)
-		case "json_lines":
-			encoder = newJSONLinesEncoder(nil)
+	newEncoder := func() (bodyEncoder, error) {
+		if s.ProtoMessage != nil {
+			return newProtobufEncoder(s.ProtoMessage), nil
 		}
-	} else {
-		switch s.Format {
-		case "json":
-			encoder, err = newGzipEncoder(compression, nil)
-		case "json_lines":
-			encoder, err = newGzipLinesEncoder(compression, nil)
+		return newBodyEncoder(s.Format, compression, framing, s.CompressionFlush)
+	}
+	encoder, err := newEncoder()
+	if err != nil {
+		return nil, err
+	}
+	var plainEncoders *sync.Pool
+	if compression > 0 && len(s.NoCompressTypes) > 0 {
+		plainEncoders = &sync.Pool{New: func() interface{} {
+			enc, _ := newBodyEncoder(s.Format, 0, framing, false)
+			return enc
+		}}
+	}
+	var encoders *sync.Pool
+	if s.Concurrency > 1 {
+		// concurrent requests can't share an encoder buffer
+		encoders = &sync.Pool{New: func() interface{} {
+			enc, _ := newEncoder()
+			return enc
+		}}
+	}
+	var pathTmpl *pathTemplate
+	if s.DynamicPath != "" {
+		pathTmpl = &pathTemplate{s.DynamicPath, s.PathMissing, s.PathLowercase}
+	}
+	method := s.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	var healthCheck *keepalive
+	if s.HealthEvery > 0 {
+		healthCheck = newKeepalive(s.HealthEvery, s.HealthMethod, s.HealthPath, s.HealthEmptyBody)
+	}
+	var keepalive *keepalive
+	if s.KeepaliveEvery > 0 {
+		keepalive = newKeepalive(s.KeepaliveEvery, s.KeepaliveMethod, s.KeepalivePath, false)
+	}
+	var requestPacer *pacer
+	if s.RequestDelay > 0 {
+		requestPacer = newPacer(s.RequestDelay)
+	}
+	var held *heldBatches
+	if s.MinBatchSize > 0 {
+		held = newHeldBatches(s.MinBatchSize, s.FlushInterval)
+	}
+	observer, onFailure := s.Observer, s.OnFailure
+	if s.fanoutHost {
+		// events a host rejected fail the host, the fanout decides whether
+		// they are dead-lettered
+		observer = nil
+		if onFailure == "dead_letter" {
+			onFailure = "retry"
 		}
-		if err != nil {
-			return nil, err
+	}
+	var deadLetter *deadLetterWriter
+	if onFailure == "dead_letter" {
+		deadLetter = newDeadLetterWriter(s.DeadLetterPath)
+	}
+	var state *statefulHeader
+	if s.StatefulHeader.RequestHeader != "" {
+		state = newStatefulHeader(s.StatefulHeader)
+	}
+	var session *bootstrap
+	if s.Bootstrap.RequestHeader != "" {
+		session = newBootstrap(s.Bootstrap)
+	}
+	var capture *responseCapture
+	if s.CaptureField != "" {
+		capture = newResponseCapture(s.CaptureField, s.CaptureIDField, s.CapturePath)
+	}
+	var signer *commandSigner
+	if s.SigningCommand != "" {
+		signer = newCommandSigner(s.SigningCommand, s.SigningArgs, s.SigningHeader, s.SigningTTL, s.SigningTimeout)
+	}
+	// with ContextTimeout each request carries the timeout as deadline of
+	// its context instead
+	clientTimeout, requestTimeout := s.Timeout, time.Duration(0)
+	if s.ContextTimeout {
+		clientTimeout, requestTimeout = 0, s.Timeout
+	}
+	doer := s.Doer
+	if doer == nil {
+		doer = &http.Client{
+			Transport: &http.Transport{
+				Dial:              dialer.Dial,
+				DialTLS:           tlsDialer.Dial,
+				Proxy:             proxy,
+				DisableKeepAlives: s.NoKeepAlives || s.HTTP10,
+			},
+			Timeout: clientTimeout,
 		}
 	}
 	client := &Client{
+		settings: s,
 		Connection: Connection{
-			URL:         s.URL,
-			Username:    s.Username,
-			Password:    s.Password,
-			ContentType: s.ContentType,
-			http: &http.Client{
-				Transport: &http.Transport{
-					Dial:    dialer.Dial,
-					DialTLS: tlsDialer.Dial,
-					Proxy:   proxy,
-				},
-				Timeout: s.Timeout,
-			},
-			encoder: encoder,
+			URL:              s.URL,
+			Username:         s.Username,
+			Password:         s.Password,
+			ContentType:      s.ContentType,
+			http:             doer,
+			encoder:          encoder,
+			encoders:         encoders,
+			plainEncoders:    plainEncoders,
+			credentials:      s.credentials,
+			jwt:              s.jwt,
+			oauth2:           s.oauth2,
+			connSlots:        s.connSlots,
+			state:            state,
+			session:          session,
+			noCompress:       s.NoCompressTypes,
+			signer:           signer,
+			trailerStatus:    s.TrailerStatus,
+			trailerSuccess:   s.TrailerSuccess,
+			teTrailers:       s.TETrailers,
+			streamMarker:     s.StreamMarker,
+			streamSuccess:    s.StreamSuccess,
+			successStatus:    s.SuccessOnStatus,
+			histograms:       s.BatchHistograms,
+			retryOnEOF:       s.RetryOnEOF,
+			prewarm:          s.Prewarm,
+			prettyBody:       s.PrettyBody,
+			slowRequest:      s.SlowRequest,
+			pacer:            requestPacer,
+			transferEncoding: s.TransferEncoding,
+			chunkThreshold:   s.ChunkThreshold,
+			http10:           s.HTTP10,
+			streamBatches:    s.CompressionFlush,
+			logFields:        s.LogFailureFields,
+			warnBodyBytes:    s.WarnBodyBytes,
+			warnBodyRaw:      s.WarnBodyRaw,
+			trailingNewline:  s.TrailingNewline,
+			requestTimeout:   requestTimeout,
+			contentMD5:       s.ContentMD5,
 		},
+		svids:            s.SVIDSource,
 		params:           params,
-		compressionLevel: compression,
-		proxyURL:         s.Proxy,
+		timeout:          s.Timeout,
 		batchPublish:     s.BatchPublish,
+		observer:         observer,
 		headers:          s.Headers,
 		format:           s.Format,
+		framing:          framing,
+		dedupField:       s.DedupField,
+		coalesceFields:   s.CoalesceFields,
+		coalesceSum:      s.CoalesceSum,
+		dedupCheckURL:    s.DedupCheckURL,
+		maxEventAge:      s.MaxEventAge,
+		retryBudget:      s.RetryBudget,
+		maxHosts:         s.MaxHosts,
+		maxRetries:       s.MaxRetries,
+		dropAfterMax:     s.DropAfterMax,
+		batchSizeHeader:  s.BatchSizeHeader,
+		batchIDHeader:    s.BatchIDHeader,
+		requestIDField:   s.RequestIDField,
+		requestIDHeader:  s.RequestIDHeader,
+		requestIDGen:     s.RequestIDGen,
+		addFields:        s.AddFields,
+		renameFields:     s.RenameFields,
+		coerceFields:     s.CoerceFields,
+		coerceDrop:       s.CoerceDrop,
+		scriptDrop:       s.ScriptDrop,
+		decimalNumbers:   s.DecimalNumbers,
+		maskFields:       s.MaskFields,
+		maskMode:         s.MaskMode,
+		flatten:          s.Flatten,
+		flattenSep:       s.FlattenSep,
+		indexArrays:      s.IndexArrays,
+		retryOnStatus:    s.RetryOnStatus,
+		dropOnStatus:     s.DropOnStatus,
+		keepalive:        keepalive,
+		healthCheck:      healthCheck,
+		onFailure:        onFailure,
+		deadLetter:       deadLetter,
+		method:           method,
+		methodField:      s.MethodField,
+		methodMap:        s.MethodMap,
+		sampleRate:       s.SampleRate,
+		sampleField:      s.SampleField,
+		concurrency:      s.Concurrency,
+		bodyField:        s.BodyField,
+		onNonObject:      s.OnNonObject,
+		nonObjectField:   s.NonObjectField,
+		contentTypeField: s.ContentTypeField,
+		capture:          capture,
+		acceptedField:    s.AcceptedField,
+		rejectedField:    s.RejectedField,
+		rejectedRetries:  s.RejectedRetries,
+		dataStreamPath:   s.DataStreamPath,
+		pathTemplate:     pathTmpl,
+		clusterField:     s.ClusterField,
+		clusterMap:       s.ClusterMap,
+		clusterMissing:   s.ClusterMissing,
+		maxPending:       s.MaxPending,
+		flushInterval:    s.FlushInterval,
+		shutdownTimeout:  s.ShutdownTimeout,
+		held:             held,
+		ws:               ws,
+		health:           s.health,
+		limiter:          s.limiter,
+		drops:            s.drops,
+		backpressure:     s.backpressure,
+		script:           s.script,
+	}
+
+	if ws != nil {
+		ws.header = func() (http.Header, error) {
+			return client.handshakeHeader(client.headers)
+		}
 	}
 
 	return client, nil
@@ -136,54 +665,208 @@ func NewClient(s ClientSettings) (*Client, error) {
 
 // Clone clones a client.
 func (client *Client) Clone() *Client {
-	// when cloning the connection callback and params are not copied. A
-	// client's close is for example generated for topology-map support. With params
-	// most likely containing the ingest node pipeline and default callback trying to
-	// create install a template, we don't want these to be included in the clone.
-	c, _ := NewClient(
-		ClientSettings{
-			URL:              client.URL,
-			Proxy:            client.proxyURL,
-			TLS:              client.tlsConfig,
-			Username:         client.Username,
-			Password:         client.Password,
-			Parameters:       client.params,
-			Timeout:          client.http.Timeout,
-			CompressionLevel: client.compressionLevel,
-			BatchPublish:     client.batchPublish,
-			Headers:          client.headers,
-			ContentType:      client.ContentType,
-			Format:           client.format,
-		},
-	)
+	// the clone is created from the same settings, so it starts without
+	// the client's connection state, session or held batches
+	s := client.settings
+	if s.ShareTransport && s.Doer == nil {
+		s.Doer = client.http
+	}
+	c, _ := NewClient(s)
 	return c
 }
 
 // Connect establishes a connection to the clients sink.
 func (conn *Connection) Connect() error {
-	conn.connected = true
+	if conn.prewarm {
+		conn.prewarmConnection()
+	}
+	if conn.pacer != nil {
+		conn.pacer.start()
+	}
+	conn.renewContext()
+	conn.setConnected(true)
 	return nil
 }
 
+// renewContext replaces the request context if abortRequests canceled it.
+func (conn *Connection) renewContext() {
+	conn.ctxMu.Lock()
+	defer conn.ctxMu.Unlock()
+	if conn.ctx != nil && conn.ctx.Err() != nil {
+		conn.ctx = nil
+	}
+}
+
+// requestContext returns the context requests are sent with.
+func (conn *Connection) requestContext() context.Context {
+	conn.ctxMu.Lock()
+	defer conn.ctxMu.Unlock()
+	if conn.ctx == nil {
+		conn.ctx, conn.abort = context.WithCancel(context.Background())
+	}
+	return conn.ctx
+}
+
+// abortRequests cancels the requests in flight and fails new ones until the
+// next Connect.
+func (conn *Connection) abortRequests() {
+	conn.ctxMu.Lock()
+	defer conn.ctxMu.Unlock()
+	if conn.ctx == nil {
+		conn.ctx, conn.abort = context.WithCancel(context.Background())
+	}
+	conn.abort()
+}
+
+// isConnected and setConnected access connected atomically, requests may
+// run concurrently with per_batch_concurrency.
+func (conn *Connection) isConnected() bool {
+	return atomic.LoadInt32(&conn.connected) == 1
+}
+
+func (conn *Connection) setConnected(connected bool) {
+	var value int32
+	if connected {
+		value = 1
+	}
+	atomic.StoreInt32(&conn.connected, value)
+}
+
+// prewarmConnection opens a connection to the sink ahead of the first
+// publish, so it can be reused from the idle pool. Failures are only logged,
+// publishing will retry the connection.
+func (conn *Connection) prewarmConnection() {
+	req, err := http.NewRequest(http.MethodHead, conn.URL, nil)
+	if err != nil {
+		logger.Warnf("Failed to create prewarm request: %v", err)
+		return
+	}
+	req, cancel := conn.withTimeout(req)
+	defer cancel()
+	resp, err := conn.http.Do(req)
+	if err != nil {
+		logger.Warnf("Failed to prewarm connection to %s: %v", conn.URL, err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	closing(resp.Body)
+}
+
 // Close closes a connection.
 func (conn *Connection) Close() error {
-	conn.connected = false
+	if conn.pacer != nil {
+		conn.pacer.stop()
+	}
+	conn.setConnected(false)
 	return nil
 }
 
+// Connect establishes a connection to the clients sink and starts sending
+// keepalive and health check requests, if configured.
+func (client *Client) Connect() error {
+	if client.session != nil {
+		// the bootstrap request must not fail for an earlier abort
+		client.renewContext()
+		if err := client.runBootstrap(); err != nil {
+			return err
+		}
+	}
+	if err := client.Connection.Connect(); err != nil {
+		return err
+	}
+	if client.keepalive != nil {
+		client.keepalive.start(client.sendKeepalive)
+	}
+	if client.healthCheck != nil {
+		client.healthCheck.start(client.sendHealthCheck)
+	}
+	return nil
+}
+
+// Close sends held events, closes the connection and stops sending
+// keepalive and health check requests.
+func (client *Client) Close() error {
+	if client.held != nil {
+		client.drainHeld()
+	}
+	if client.keepalive != nil {
+		client.keepalive.stop()
+	}
+	if client.healthCheck != nil {
+		client.healthCheck.stop()
+	}
+	if client.ws != nil {
+		client.ws.close()
+	}
+	return client.Connection.Close()
+}
+
 func (client *Client) String() string {
 	return client.URL
 }
 
 // Publish sends events to the clients sink.
 func (client *Client) Publish(_ context.Context, batch publisher.Batch) error {
+	if client.observer != nil {
+		client.observer.NewBatch(len(batch.Events()))
+	}
+	queued := int64(len(batch.Events()))
+	queueDepth.Add(queued)
+	if client.backpressure != nil {
+		client.backpressure.update()
+	}
+	defer func(start time.Time) {
+		queueDepth.Add(-queued)
+		if client.backpressure != nil {
+			client.backpressure.observe(time.Since(start))
+			client.backpressure.update()
+		}
+	}(time.Now())
+	if client.held != nil {
+		return client.publishHeld(batch)
+	}
 	events := batch.Events()
 	rest, err := client.publishEvents(events)
+	client.markHealth(len(rest) == 0)
+	return client.settle(batch, events, rest, err)
+}
+
+// markHealth records whether publishing to the host of the client worked.
+func (client *Client) markHealth(up bool) {
+	if client.health == nil {
+		return
+	}
+	if up {
+		client.health.markUp(client.URL)
+	} else {
+		client.health.markDown(client.URL)
+	}
+}
+
+// settle acknowledges batch if none of its events are left in rest, and
+// otherwise drops or retries the events of rest that failed with err.
+func (client *Client) settle(batch publisher.Batch, events, rest []publisher.Event, err error) error {
 	if len(rest) == 0 {
+		observeRetries(events)
 		batch.ACK()
-	} else {
-		batch.RetryEvents(rest)
+		return err
+	}
+	if client.health != nil {
+		if down := client.health.allDownFor(); down >= client.maxPending {
+			logger.Debugf("All hosts down for %v, dropping %d events.", down, len(rest))
+			client.dropEvents("hosts_down", len(rest))
+			batch.Drop()
+			return err
+		}
 	}
+	client.recordTriedHost(rest)
+	rest = client.dropOverMaxRetries(rest, err)
+	if len(rest) == 0 {
+		batch.Drop()
+		return err
+	}
+	countRetries(rest, client.observer)
+	batch.RetryEvents(rest)
 	return err
 }
 
@@ -194,18 +877,50 @@ func (client *Client) publishEvents(data []publisher.Event) ([]publisher.Event,
 	if len(data) == 0 {
 		return nil, nil
 	}
-	if !client.connected {
+	batchesTotal.Add(1)
+	eventsTotal.Add(int64(len(data)))
+	if client.keepalive != nil {
+		client.keepalive.touch()
+	}
+	if !client.isConnected() {
 		return data, ErrNotConnected
 	}
+	data = client.dropExpired(data)
+	data = client.dropOverBudget(data)
+	data = client.dropOverMaxHosts(data)
+	data = client.dropUnknownClusters(data)
+	data = client.sampleEvents(data)
+	data = client.dedupEvents(data)
+	data = client.dropStored(data)
+	data = client.scriptEvents(data)
+	data = client.coalesceEvents(data)
+	if err := client.throttle(len(data)); err != nil {
+		return data, err
+	}
 	var failedEvents []publisher.Event
 	sendErr := error(nil)
-	if client.batchPublish {
+	if client.ws != nil {
+		logger.Debugf("Publishing events over WebSocket.")
+		failedEvents, sendErr = client.publishFrames(data)
+	} else if client.batchPublish {
 		// Publish events in bulk
 		logger.Debugf("Publishing events in batch.")
-		sendErr = client.BatchPublishEvent(data)
-		if sendErr != nil {
-			return data, sendErr
+		groups := client.groupByRoute(data)
+		for index, group := range groups {
+			var failed []publisher.Event
+			failed, sendErr = client.publishBatch(group, 0)
+			if sendErr != nil {
+				// return the unpublished events and all following groups with the error
+				failedEvents = append(failedEvents, failed...)
+				for _, rest := range groups[index+1:] {
+					failedEvents = append(failedEvents, rest...)
+				}
+				break
+			}
 		}
+	} else if client.concurrency > 1 {
+		logger.Debugf("Publishing events one by one using %d workers.", client.concurrency)
+		failedEvents, sendErr = client.publishConcurrently(data)
 	} else {
 		logger.Debugf("Publishing events one by one.")
 		for index, event := range data {
@@ -224,116 +939,1072 @@ func (client *Client) publishEvents(data []publisher.Event) ([]publisher.Event,
 	return nil, nil
 }
 
+// throttle blocks until the global rate limit allows sending n events. The
+// wait is split into chunks of the limiter's burst, as WaitN fails for more.
+// It fails if the wait is aborted, see abortRequests.
+func (client *Client) throttle(n int) error {
+	if client.limiter == nil {
+		return nil
+	}
+	ctx := client.requestContext()
+	burst := client.limiter.Burst()
+	for n > 0 {
+		chunk := n
+		if burst > 0 && chunk > burst {
+			chunk = burst
+		}
+		if err := client.limiter.WaitN(ctx, chunk); err != nil {
+			return fmt.Errorf("global_rate_limit: %v", err)
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// publishConcurrently publishes data one event at a time using up to
+// client.concurrency parallel requests. Events are not sent in order.
+func (client *Client) publishConcurrently(data []publisher.Event) ([]publisher.Event, error) {
+	// each worker only writes the results of the events it published
+	errs := make([]error, len(data))
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < client.concurrency && i < len(data); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = client.PublishEvent(data[i])
+			}
+		}()
+	}
+	for i := range data {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var failed []publisher.Event
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, data[i])
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return failed, firstErr
+}
+
+// dropOverBudget gives up on events that are retried for longer than
+// client.retryBudget. They are dead-lettered if on_failure is dead_letter
+// and dropped otherwise.
+func (client *Client) dropOverBudget(data []publisher.Event) []publisher.Event {
+	if client.retryBudget <= 0 {
+		return data
+	}
+	kept := make([]publisher.Event, 0, len(data))
+	var exceeded []publisher.Event
+	for i := range data {
+		if retryingFor(&data[i]) > client.retryBudget {
+			exceeded = append(exceeded, data[i])
+			continue
+		}
+		kept = append(kept, data[i])
+	}
+	if len(exceeded) == 0 {
+		return data
+	}
+	logger.Warnf("Giving up on %d events retried for longer than %v.", len(exceeded), client.retryBudget)
+	eventsOverBudget.Add(int64(len(exceeded)))
+	client.abandon(exceeded, "retry_budget", ErrRetryBudget)
+	return kept
+}
+
+// dropOverMaxRetries gives up on failed events that were already retried
+// client.maxRetries times, so that every event is sent at most
+// max_retries+1 times, instead of returning them to the pipeline. It does
+// nothing unless drop_after_max_retries is set or if max_retries is
+// negative.
+func (client *Client) dropOverMaxRetries(data []publisher.Event, err error) []publisher.Event {
+	if !client.dropAfterMax || client.maxRetries < 0 {
+		return data
+	}
+	kept := make([]publisher.Event, 0, len(data))
+	var exceeded []publisher.Event
+	for i := range data {
+		if eventRetries(&data[i]) >= client.maxRetries {
+			exceeded = append(exceeded, data[i])
+			continue
+		}
+		kept = append(kept, data[i])
+	}
+	if len(exceeded) == 0 {
+		return data
+	}
+	logger.Warnf("Giving up on %d events after %d retries: %v", len(exceeded), client.maxRetries, err)
+	eventsOverMaxRetries.Add(int64(len(exceeded)))
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrMaxRetries, err)
+	} else {
+		err = ErrMaxRetries
+	}
+	client.abandon(exceeded, "max_retries", err)
+	return kept
+}
+
+// dropOverMaxHosts gives up on events that already failed on
+// client.maxHosts other hosts, instead of trying yet another host.
+func (client *Client) dropOverMaxHosts(data []publisher.Event) []publisher.Event {
+	if client.maxHosts <= 0 {
+		return data
+	}
+	kept := make([]publisher.Event, 0, len(data))
+	var exceeded []publisher.Event
+	for i := range data {
+		tried := triedHosts(&data[i])
+		if len(tried) >= client.maxHosts && !containsString(tried, client.URL) {
+			exceeded = append(exceeded, data[i])
+			continue
+		}
+		kept = append(kept, data[i])
+	}
+	if len(exceeded) == 0 {
+		return data
+	}
+	logger.Warnf("Giving up on %d events that failed on %d hosts.", len(exceeded), client.maxHosts)
+	eventsOverMaxHosts.Add(int64(len(exceeded)))
+	client.abandon(exceeded, "max_hosts", ErrMaxHosts)
+	return kept
+}
+
+// recordTriedHost adds this client's host to the hosts the events failed on.
+func (client *Client) recordTriedHost(events []publisher.Event) {
+	if client.maxHosts <= 0 {
+		return
+	}
+	for i := range events {
+		tried := triedHosts(&events[i])
+		if !containsString(tried, client.URL) {
+			events[i].Cache.Put(triedHostsKey, append(tried[:len(tried):len(tried)], client.URL))
+		}
+	}
+}
+
+func triedHosts(event *publisher.Event) []string {
+	value, err := event.Cache.GetValue(triedHostsKey)
+	if err != nil {
+		return nil
+	}
+	hosts, _ := value.([]string)
+	return hosts
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// abandon dead-letters events that are not retried anymore if on_failure is
+// dead_letter, and drops them otherwise.
+func (client *Client) abandon(events []publisher.Event, reason string, err error) {
+	if client.deadLetter == nil {
+		client.dropEvents(reason, len(events))
+		return
+	}
+	client.deadLetter.Write(events, err)
+	if client.observer != nil {
+		client.observer.Dropped(len(events))
+	}
+}
+
+// dropEvents records n events dropped for reason in the drop summary, the
+// counter of the reason if it has one, and the observer.
+func (client *Client) dropEvents(reason string, n int) {
+	client.drops.record(reason, n)
+	if counter, ok := dropCounters[reason]; ok {
+		counter.Add(int64(n))
+	}
+	if client.observer != nil {
+		client.observer.Dropped(n)
+	}
+}
+
+// dropExpired drops events whose timestamp is older than client.maxEventAge.
+func (client *Client) dropExpired(data []publisher.Event) []publisher.Event {
+	if client.maxEventAge <= 0 {
+		return data
+	}
+	oldest := time.Now().Add(-client.maxEventAge)
+	kept := make([]publisher.Event, 0, len(data))
+	for _, event := range data {
+		if event.Content.Timestamp.Before(oldest) {
+			continue
+		}
+		kept = append(kept, event)
+	}
+	if dropped := len(data) - len(kept); dropped > 0 {
+		logger.Debugf("Dropped %d events older than %v.", dropped, client.maxEventAge)
+		client.dropEvents("expired", dropped)
+	}
+	return kept
+}
+
+// dropUnknownClusters drops events whose cluster field doesn't name a
+// cluster in client.clusterMap, if configured to do so.
+func (client *Client) dropUnknownClusters(data []publisher.Event) []publisher.Event {
+	if client.clusterField == "" || client.clusterMissing != "drop" {
+		return data
+	}
+	kept := make([]publisher.Event, 0, len(data))
+	for _, event := range data {
+		if _, ok := client.clusterURL(&event.Content); ok {
+			kept = append(kept, event)
+		}
+	}
+	if dropped := len(data) - len(kept); dropped > 0 {
+		logger.Debugf("Dropped %d events of unknown clusters.", dropped)
+		client.dropEvents("unknown_cluster", dropped)
+	}
+	return kept
+}
+
+// clusterURL returns the base URL of the cluster named by the event.
+func (client *Client) clusterURL(event *beat.Event) (string, bool) {
+	value, err := event.GetValue(client.clusterField)
+	if err != nil {
+		return "", false
+	}
+	base, ok := client.clusterMap[fmt.Sprint(value)]
+	return base, ok
+}
+
+// sampleEvents keeps each event with probability client.sampleRate. If a
+// sample field is configured, events with the same field value are either
+// all kept or all dropped.
+func (client *Client) sampleEvents(data []publisher.Event) []publisher.Event {
+	if client.sampleRate <= 0 || client.sampleRate >= 1 {
+		// a rate of 0 means sampling is not configured, see ClientSettings
+		return data
+	}
+	kept := make([]publisher.Event, 0, len(data))
+	for _, event := range data {
+		if client.sampled(&event.Content) {
+			kept = append(kept, event)
+		}
+	}
+	if dropped := len(data) - len(kept); dropped > 0 {
+		client.dropEvents("sampled", dropped)
+	}
+	return kept
+}
+
+func (client *Client) sampled(event *beat.Event) bool {
+	if client.sampleField != "" {
+		if value, err := event.GetValue(client.sampleField); err == nil {
+			h := fnv.New64a()
+			fmt.Fprint(h, value)
+			return float64(h.Sum64())/math.MaxUint64 < client.sampleRate
+		}
+	}
+	return mathrand.Float64() < client.sampleRate
+}
+
+// dedupEvents drops events whose dedup field value was already seen earlier
+// in the same batch, keeping the first occurrence. Events without the field
+// are always kept.
+func (client *Client) dedupEvents(data []publisher.Event) []publisher.Event {
+	if client.dedupField == "" {
+		return data
+	}
+	seen := make(map[string]struct{}, len(data))
+	kept := make([]publisher.Event, 0, len(data))
+	for _, event := range data {
+		value, err := event.Content.GetValue(client.dedupField)
+		if err != nil {
+			kept = append(kept, event)
+			continue
+		}
+		key := fmt.Sprint(value)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		kept = append(kept, event)
+	}
+	if dropped := len(data) - len(kept); dropped > 0 {
+		logger.Debugf("Dropped %d duplicate events by field %s.", dropped, client.dedupField)
+		client.dropEvents("duplicate", dropped)
+	}
+	return kept
+}
+
+// eventRoute returns the HTTP method and the URL an event is published with.
+func (client *Client) eventRoute(event *beat.Event) (method, urlStr string) {
+	method = client.method
+	if client.methodField != "" {
+		if value, err := event.GetValue(client.methodField); err == nil {
+			if m, ok := client.methodMap[fmt.Sprint(value)]; ok {
+				method = m
+			}
+		}
+	}
+	var path string
+	if client.dataStreamPath {
+		path = dataStreamName(event)
+	} else if client.pathTemplate != nil {
+		path = client.pathTemplate.Expand(event)
+	}
+	base := client.URL
+	if client.clusterField != "" {
+		if cluster, ok := client.clusterURL(event); ok {
+			base = cluster
+		}
+	}
+	return method, joinURLPath(base, path)
+}
+
+// groupByRoute splits data into batches of events sharing the same method
+// and URL, keeping the order in which routes first appear.
+func (client *Client) groupByRoute(data []publisher.Event) [][]publisher.Event {
+	if !client.dataStreamPath && client.pathTemplate == nil && client.methodField == "" && client.clusterField == "" {
+		return [][]publisher.Event{data}
+	}
+	type route struct{ method, url string }
+	var groups [][]publisher.Event
+	index := make(map[route]int)
+	for _, event := range data {
+		method, urlStr := client.eventRoute(&event.Content)
+		key := route{method, urlStr}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], event)
+	}
+	return groups
+}
+
 // BatchPublishEvent publish a single event to output.
 func (client *Client) BatchPublishEvent(data []publisher.Event) error {
-	if !client.connected {
-		return ErrNotConnected
+	_, err := client.publishBatch(data, 0)
+	return err
+}
+
+// batchHeaders returns the request headers for a batch of size events,
+// including the configured batch metadata headers.
+func (client *Client) batchHeaders(size int) map[string]string {
+	if client.batchSizeHeader == "" && client.batchIDHeader == "" {
+		return client.headers
+	}
+	headers := make(map[string]string, len(client.headers)+2)
+	for key, value := range client.headers {
+		headers[key] = value
+	}
+	if client.batchSizeHeader != "" {
+		headers[client.batchSizeHeader] = strconv.Itoa(size)
+	}
+	if client.batchIDHeader != "" {
+		headers[client.batchIDHeader] = newUUID()
+	}
+	return headers
+}
+
+// eventHeaders returns the request headers for event, including its request
+// ID taken from requestIDField or, if missing and requestIDGen is set, a new
+// UUID.
+func (client *Client) eventHeaders(event *beat.Event) map[string]string {
+	if client.requestIDField == "" && !client.requestIDGen {
+		return client.headers
+	}
+	var id string
+	if client.requestIDField != "" {
+		if value, err := event.GetValue(client.requestIDField); err == nil {
+			id = fmt.Sprint(value)
+		}
+	}
+	if id == "" && client.requestIDGen {
+		id = newUUID()
+	}
+	if id == "" {
+		return client.headers
+	}
+	headers := make(map[string]string, len(client.headers)+1)
+	for key, value := range client.headers {
+		headers[key] = value
+	}
+	headers[client.requestIDHeader] = id
+	return headers
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		logger.Warnf("Failed to generate UUID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// maxBatchSplitDepth bounds how often a batch rejected as too large is
+// split in half before its events are dropped.
+const maxBatchSplitDepth = 16
+
+// publishBatch publishes data in a single request, returning the events that
+// have not been published on error.
+func (client *Client) publishBatch(data []publisher.Event, depth int) ([]publisher.Event, error) {
+	if !client.isConnected() {
+		return data, ErrNotConnected
+	}
+	if len(data) == 0 {
+		return nil, nil
 	}
 	var events = make([]eventRaw, len(data))
 	for i, event := range data {
-		events[i] = makeEvent(&event.Content)
+		events[i] = client.encodeEvent(&event.Content)
+	}
+	// all events of a batch share the same route, see groupByRoute
+	method, urlStr := client.eventRoute(&data[0].Content)
+	status, resp, err := client.request(method, urlStr, client.ContentType, client.params, events, client.batchHeaders(len(data)))
+	if err == ErrJSONEncodeFailed {
+		// don't retry unencodable values
+		client.dropEvents("encode", len(data))
+		return nil, nil
 	}
-	status, _, err := client.request("POST", client.params, events, client.headers)
 	if err != nil {
-		logger.Warn("Fail to insert a single event: %s", err)
-		if err == ErrJSONEncodeFailed {
-			// don't retry unencodable values
-			return nil
+		if client.classify(status, err) == statusDrop {
+			// counted by the drop summary
+			logger.Debugf("Dropping %d events: %s", len(data), err)
+		} else {
+			logger.Warn("Fail to insert a single event: %s", err)
+		}
+		if isReportedFailure(err) {
+			// the server reported a failure after sending a success status
+			return data, err
 		}
 	}
-	switch {
-	case status == 500 || status == 400: //server error or bad input, don't retry
-		return nil
-	case status >= 300:
-		// retry
-		return err
+	if status == http.StatusRequestEntityTooLarge && !client.statusConfigured(status) {
+		return client.splitBatch(data, depth)
 	}
-	return nil
+	switch client.classify(status, err) {
+	case statusDrop:
+		if err := client.rejected(data, err); err != nil {
+			return data, err
+		}
+		return nil, nil
+	case statusRetry:
+		return data, err
+	case statusSuccess:
+		if client.acceptedField != "" || client.rejectedField != "" {
+			if rejected, ok := client.rejectedCount(resp, len(data)); ok && rejected > 0 {
+				return client.rejectedBatch(data, rejected)
+			}
+		}
+		client.acked(len(data))
+	}
+	return nil, nil
+}
+
+// rejectedBatch retries a batch the response reported rejected events of.
+// Which events were rejected is unknown, so the whole batch is retried, up
+// to rejectedRetries times before it is given up on.
+func (client *Client) rejectedBatch(data []publisher.Event, rejected int) ([]publisher.Event, error) {
+	err := fmt.Errorf("%w: %d of %d", ErrRejectedCount, rejected, len(data))
+	if eventRetries(&data[0]) < client.rejectedRetries {
+		logger.Warnf("Retrying batch: %v", err)
+		return data, err
+	}
+	logger.Debugf("Giving up on batch after %d retries: %v", client.rejectedRetries, err)
+	client.abandon(data, "rejected_count", err)
+	return nil, nil
+}
+
+// splitBatch publishes the two halves of a batch that was rejected as too
+// large. Single events, or batches split too often, are dropped.
+func (client *Client) splitBatch(data []publisher.Event, depth int) ([]publisher.Event, error) {
+	if len(data) == 1 || depth >= maxBatchSplitDepth {
+		logger.Debugf("Dropping %d events rejected as too large.", len(data))
+		client.dropEvents("too_large", len(data))
+		return nil, nil
+	}
+	if client.observer != nil {
+		client.observer.Split()
+	}
+	mid := len(data) / 2
+	halves := [][]publisher.Event{data[:mid], data[mid:]}
+	for i, half := range halves {
+		failed, err := client.publishBatch(half, depth+1)
+		if err != nil {
+			rest := make([]publisher.Event, 0, len(data))
+			rest = append(rest, failed...)
+			if i == 0 {
+				rest = append(rest, halves[1]...)
+			}
+			return rest, err
+		}
+	}
+	return nil, nil
 }
 
 // PublishEvent publish a single event to output.
 func (client *Client) PublishEvent(data publisher.Event) error {
-	if !client.connected {
+	if !client.isConnected() {
 		return ErrNotConnected
 	}
 	event := data
 	logger.Debugf("Publish event: %s", event)
-	status, _, err := client.request("POST", client.params, makeEvent(&event.Content), client.headers)
-	if err != nil {
-		logger.Warn("Fail to insert a single event: %s", err)
-		if err == ErrJSONEncodeFailed {
-			// don't retry unencodable values
+	var body interface{}
+	if client.bodyField != "" {
+		raw, err := eventBody(&event.Content, client.bodyField)
+		if err != nil {
+			// events without a usable body can never be sent, don't retry
+			logger.Debugf("Dropping event: %v", err)
+			client.dropEvents("body_field", 1)
 			return nil
 		}
+		var ok bool
+		if body, ok = client.objectBody(raw); !ok {
+			logger.Debugf("Dropping event, body field %s is not a JSON object", client.bodyField)
+			client.dropEvents("non_object", 1)
+			return nil
+		}
+	} else {
+		body = client.encodeEvent(&event.Content)
 	}
-	switch {
-	case status == 500 || status == 400: //server error or bad input, don't retry
+	method, urlStr := client.eventRoute(&event.Content)
+	contentType := client.eventContentType(&event.Content)
+	status, resp, err := client.request(method, urlStr, contentType, client.params, body, client.eventHeaders(&event.Content))
+	if err == ErrJSONEncodeFailed {
+		// don't retry unencodable values
+		client.dropEvents("encode", 1)
 		return nil
-	case status >= 300:
-		// retry
+	}
+	if err != nil {
+		if client.classify(status, err) == statusDrop {
+			// counted by the drop summary
+			logger.Debugf("Dropping event%s: %s", client.failureContext(&event.Content), err)
+		} else {
+			logger.Warnf("Fail to insert a single event%s: %s", client.failureContext(&event.Content), err)
+		}
+		if isReportedFailure(err) {
+			// the server reported a failure after sending a success status
+			return err
+		}
+	}
+	switch client.classify(status, err) {
+	case statusDrop:
+		return client.rejected([]publisher.Event{data}, err)
+	case statusRetry:
 		return err
 	}
-	if !client.connected {
+	if !client.isConnected() {
 		return ErrNotConnected
 	}
+	if client.capture != nil {
+		client.capture.record(&event.Content, resp)
+	}
+	client.acked(1)
 	return nil
 }
 
-func (conn *Connection) request(method string, params map[string]string, body interface{}, headers map[string]string) (int, []byte, error) {
-	urlStr := addToURL(conn.URL, params)
-	logger.Debugf("%s %s %v", method, urlStr, body)
+// acked reports events accepted by the sink to the observer. Rejected
+// events are reported as dropped, events to be retried as failed, see
+// rejected and countRetries.
+func (client *Client) acked(n int) {
+	if client.observer != nil {
+		client.observer.Acked(n)
+	}
+}
+
+type statusClass int
+
+const (
+	statusSuccess statusClass = iota
+	statusRetry
+	statusDrop
+)
+
+// classify is classifyStatus for the outcome of a request. A request that
+// failed without a response, e.g. because it couldn't be signed or
+// authorized or the connection broke, is retried.
+func (client *Client) classify(status int, err error) statusClass {
+	if status == 0 && err != nil {
+		return statusRetry
+	}
+	return client.classifyStatus(status)
+}
+
+// classifyStatus decides whether a response status means success, a
+// temporary failure worth retrying or a permanent rejection. The configured
+// success_on_status, retry_on_status and drop_on_status lists take
+// precedence over the defaults.
+func (client *Client) classifyStatus(status int) statusClass {
+	switch {
+	case containsStatus(client.successStatus, status):
+		return statusSuccess
+	case containsStatus(client.retryOnStatus, status):
+		return statusRetry
+	case containsStatus(client.dropOnStatus, status):
+		return statusDrop
+	case status == 500 || status == 400: //server error or bad input, don't retry
+		return statusDrop
+	case status >= 300:
+		return statusRetry
+	}
+	return statusSuccess
+}
+
+// statusConfigured reports whether status is explicitly classified by config.
+func (client *Client) statusConfigured(status int) bool {
+	return containsStatus(client.successStatus, status) ||
+		containsStatus(client.retryOnStatus, status) ||
+		containsStatus(client.dropOnStatus, status)
+}
+
+func containsStatus(list []int, status int) bool {
+	for _, s := range list {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// rejected applies the on_failure policy to events the server rejected with
+// a status that is not worth retrying. It returns an error if the events are
+// to be retried anyway.
+func (client *Client) rejected(events []publisher.Event, err error) error {
+	switch client.onFailure {
+	case "retry":
+		return err
+	case "dead_letter":
+		client.deadLetter.Write(events, err)
+		// dead-lettered events leave the pipeline unacknowledged as well
+		if client.observer != nil {
+			client.observer.Dropped(len(events))
+		}
+	default:
+		client.drops.keepSample(&events[0].Content)
+		client.dropEvents("rejected", len(events))
+	}
+	return nil
+}
+
+// request sends body to urlStr. An empty contentType selects the encoder's
+// default content type.
+func (conn *Connection) request(method, urlStr, contentType string, params url.Values, body interface{}, headers map[string]string) (int, []byte, error) {
+	urlStr = addToURL(urlStr, params)
+	if conn.pacer != nil && !conn.pacer.wait() {
+		// the client was closed while the request waited for its turn
+		conn.setConnected(false)
+		return 0, nil, ErrNotConnected
+	}
+	if conn.prettyBody && logp.IsDebug(selector) {
+		logger.Debugf("%s %s\n%s", method, urlStr, prettyBody(body))
+	} else {
+		logger.Debugf("%s %s %v", method, urlStr, body)
+	}
 
 	if body == nil {
-		return conn.execRequest(method, urlStr, nil, headers)
+		return conn.execRequest(method, urlStr, nil, "", nil, headers)
 	}
 
-	if err := conn.encoder.Marshal(body); err != nil {
-		logger.Warn("Failed to json encode body (%v): %#v", err, body)
+	encoder, pool := conn.encoder, conn.encoders
+	if conn.plainEncoders != nil && !compressible(contentType, conn.noCompress) {
+		pool = conn.plainEncoders
+	}
+	if pool != nil {
+		encoder = pool.Get().(bodyEncoder)
+		defer pool.Put(encoder)
+	}
+	if events, ok := body.([]eventRaw); ok && conn.streamBatches {
+		if stream, ok := encoder.(streamEncoder); ok {
+			return conn.streamRequest(method, urlStr, stream, contentType, events, headers)
+		}
+	}
+	if raw, ok := body.(rawBody); ok {
+		if conn.trailingNewline && !bytes.HasSuffix(raw, []byte("\n")) {
+			raw = append(raw[:len(raw):len(raw)], '\n')
+		}
+		if err := encoder.MarshalRaw(raw); err != nil {
+			logger.Warnf("Failed to encode raw body: %v", err)
+			return 0, nil, err
+		}
+	} else if err := encoder.Marshal(body); err != nil {
+		logger.Debugf("Failed to json encode body (%v): %#v", err, body)
 		return 0, nil, ErrJSONEncodeFailed
 	}
-	return conn.execRequest(method, urlStr, conn.encoder.Reader(), headers)
+	reader := encoder.Reader()
+	switch encoder.(type) {
+	case *gzipEncoder, *gzipLinesEncoder:
+		observeCompression(encoder.Sizes())
+	}
+	if conn.histograms {
+		events := 1
+		if batch, ok := body.([]eventRaw); ok {
+			events = len(batch)
+		}
+		raw, encoded := encoder.Sizes()
+		observeBody(events, raw, encoded)
+	}
+	if conn.warnBodyBytes > 0 {
+		conn.checkBodySize(method, urlStr, encoder, body)
+	}
+	return conn.execRequest(method, urlStr, encoder, contentType, reader, headers)
+}
+
+// streamRequest sends events while encoder compresses them, so the server
+// receives every event as soon as it was flushed. The size of the body is not
+// known up front, so it is neither observed nor checked against
+// warn_body_bytes.
+func (conn *Connection) streamRequest(method, urlStr string, encoder streamEncoder, contentType string, events []eventRaw, headers map[string]string) (int, []byte, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(encoder.Stream(pw, events))
+	}()
+	status, obj, err := conn.execRequest(method, urlStr, encoder, contentType, pr, headers)
+	// unblocks the encoder if the request failed before the body was read,
+	// it must be done before the encoder is reused
+	pr.Close()
+	<-done
+	return status, obj, err
+}
+
+// compressible reports whether bodies of contentType may be compressed.
+// Entries of exclude are media types, or type/* to match all subtypes.
+func compressible(contentType string, exclude []string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	for _, excluded := range exclude {
+		excluded = strings.ToLower(excluded)
+		if excluded == mediaType {
+			return false
+		}
+		if strings.HasSuffix(excluded, "/*") && strings.HasPrefix(mediaType, excluded[:len(excluded)-1]) {
+			return false
+		}
+	}
+	return true
 }
 
-func (conn *Connection) execRequest(method, url string, body io.Reader, headers map[string]string) (int, []byte, error) {
+func (conn *Connection) execRequest(method, url string, encoder bodyEncoder, contentType string, body io.Reader, headers map[string]string) (int, []byte, error) {
+	if body != nil && conn.transferEncoding != "chunked" {
+		// Content-Length can only be set for bodies of known length
+		var err error
+		if body, err = bufferBody(body); err != nil {
+			return 0, nil, err
+		}
+	}
+	var payload []byte
+	if body != nil && (conn.signer != nil || conn.contentMD5) {
+		var err error
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return 0, nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+	var signature string
+	if conn.signer != nil {
+		var err error
+		if signature, err = conn.signer.Sign(payload); err != nil {
+			logger.Warnf("Failed to sign request: %v", err)
+			return 0, nil, err
+		}
+	}
+
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		logger.Warn("Failed to create request: %v", err)
 		return 0, nil, err
 	}
 	if body != nil {
-		conn.encoder.AddHeader(&req.Header, conn.ContentType)
+		encoder.AddHeader(&req.Header, contentType)
+		sized, ok := body.(interface{ Len() int })
+		if conn.transferEncoding == "chunked" || conn.transferEncoding == "auto" && ok && sized.Len() > conn.chunkThreshold {
+			req.TransferEncoding = []string{"chunked"}
+		} else if ok {
+			// compressed bodies are fully buffered too, so strict servers
+			// get the compressed length rather than a chunked body
+			req.ContentLength = int64(sized.Len())
+		}
+	}
+	if signature != "" {
+		req.Header.Set(conn.signer.header, signature)
+	}
+	if conn.contentMD5 && body != nil {
+		// Content-MD5 is computed over the bytes sent, i.e. after compression
+		sum := md5.Sum(payload)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	if conn.http10 {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+		req.Close = true
 	}
 	return conn.execHTTPRequest(req, headers)
 }
 
+// prettyBody formats body as indented JSON for logging.
+func prettyBody(body interface{}) string {
+	if raw, ok := body.(rawBody); ok {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, raw, "", "  "); err != nil {
+			return raw.String()
+		}
+		return buf.String()
+	}
+	b, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%v", body)
+	}
+	return string(b)
+}
+
+// bufferBody reads body into memory unless its length is already known.
+func bufferBody(body io.Reader) (io.Reader, error) {
+	switch body.(type) {
+	case *bytes.Buffer, *bytes.Reader, *strings.Reader:
+		return body, nil
+	}
+	payload, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(payload), nil
+}
+
 func (conn *Connection) execHTTPRequest(req *http.Request, headers map[string]string) (int, []byte, error) {
+	if err := conn.authorize(req, headers); err != nil {
+		// nothing was sent, the events are retried on the same connection
+		logger.Warnf("Not sending %s %s: %v", req.Method, req.URL, err)
+		return 0, nil, err
+	}
+	status, obj, err := conn.roundTrip(req)
+	if err != nil && status == 0 && isConnClosed(err) && rewindBody(req) == nil {
+		// most likely the server closed an idle keep-alive connection
+		logger.Debugf("Retrying %s %s on a new connection: %v", req.Method, req.URL, err)
+		if c, ok := conn.http.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+		status, obj, err = conn.roundTrip(req)
+	}
+	if err != nil && conn.retryOnEOF && isEOF(err) && isIdempotent(req.Method) && rewindBody(req) == nil {
+		logger.Debugf("Retrying %s %s after reading response failed: %v", req.Method, req.URL, err)
+		status, obj, err = conn.roundTrip(req)
+	}
+	// a rejected payload or a failure reported in the trailer or stream
+	// doesn't say anything about the connection
+	if err != nil && !isReportedFailure(err) && status != http.StatusRequestEntityTooLarge {
+		conn.setConnected(false)
+	}
+	return status, obj, err
+}
+
+// authorize adds headers, the credentials and the session and state headers
+// to req, like to every request sent to the sink.
+func (conn *Connection) authorize(req *http.Request, headers map[string]string) error {
+	conn.addHeaders(req, headers)
+	if err := conn.addBearerToken(req.Header); err != nil {
+		return fmt.Errorf("%w: %v", ErrBearerToken, err)
+	}
+	if conn.state != nil {
+		conn.state.apply(req.Header)
+	}
+	if conn.session != nil {
+		conn.session.apply(req.Header)
+	}
+	return nil
+}
+
+func (conn *Connection) addHeaders(req *http.Request, headers map[string]string) {
 	req.Header.Add("Accept", "application/json")
+	if conn.teTrailers {
+		// some servers only send the status trailer when it was advertised
+		req.Header.Set("TE", "trailers")
+	}
 	for key, value := range headers {
 		req.Header.Add(key, value)
 	}
-	if conn.Username != "" || conn.Password != "" {
-		req.SetBasicAuth(conn.Username, conn.Password)
+	username, password := conn.Username, conn.Password
+	if conn.credentials != nil {
+		username, password = conn.credentials.get(username, password)
+	}
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
 	}
+}
+
+// addBearerToken sets the Authorization header to the JWT or OAuth2 access
+// token, if configured.
+func (conn *Connection) addBearerToken(header http.Header) error {
+	var token string
+	var err error
+	switch {
+	case conn.jwt != nil:
+		token, err = conn.jwt.Token()
+	case conn.oauth2 != nil:
+		token, err = conn.oauth2.Token()
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (conn *Connection) roundTrip(req *http.Request) (int, []byte, error) {
+	if conn.connSlots != nil {
+		// the slot is held until the response body is read
+		ctx := conn.requestContext()
+		select {
+		case conn.connSlots <- struct{}{}:
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+		defer func() { <-conn.connSlots }()
+	}
+	return conn.exchange(req)
+}
+
+// exchange is roundTrip without taking one of the connSlots.
+func (conn *Connection) exchange(req *http.Request) (int, []byte, error) {
+	requestsInFlight.Add(1)
+	defer requestsInFlight.Add(-1)
+	requestsTotal.Add(1)
+	if req.ContentLength > 0 {
+		bytesSentTotal.Add(req.ContentLength)
+	}
+
+	req, cancel := conn.withTimeout(req.WithContext(conn.requestContext()))
+	defer cancel()
+	start := time.Now()
 	resp, err := conn.http.Do(req)
+	// only the time until the response headers arrived is the server's
+	if took := time.Since(start); conn.slowRequest > 0 && took > conn.slowRequest {
+		logger.Warnf("Slow request: %s %s took %v", req.Method, req.URL, took)
+	}
 	if err != nil {
-		conn.connected = false
 		return 0, nil, err
 	}
 	defer closing(resp.Body)
 
 	status := resp.StatusCode
-	if status >= 300 {
-		conn.connected = false
+	// a status configured as success is handled like a 2xx, so it neither
+	// fails the request nor marks the connection as broken
+	if status >= 300 && !containsStatus(conn.successStatus, status) {
 		return status, nil, fmt.Errorf("%v", resp.Status)
 	}
-	obj, err := ioutil.ReadAll(resp.Body)
+	// the events were accepted, a body that can't be decoded is kept as is
+	body, err := decodeBody(resp)
+	if err != nil {
+		logger.Debugf("Reading response body without decoding: %v", err)
+		body = resp.Body
+	}
+	if conn.streamMarker != "" {
+		obj, err := conn.readStream(body)
+		if err == nil && conn.state != nil {
+			conn.state.capture(resp.Header, obj)
+		}
+		return status, obj, err
+	}
+	obj, err := ioutil.ReadAll(body)
 	if err != nil {
-		conn.connected = false
 		return status, nil, err
 	}
+	// trailers are only available once the body has been read completely
+	if err := conn.checkTrailer(resp.Trailer); err != nil {
+		return status, obj, err
+	}
+	if conn.state != nil {
+		conn.state.capture(resp.Header, obj)
+	}
 	return status, obj, nil
 }
 
+// withTimeout returns req with a context that is canceled after the request
+// timeout, if it is enforced by the context. The deadline covers reading the
+// response body too, so cancel must only be called once it was read.
+func (conn *Connection) withTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	if conn.requestTimeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), conn.requestTimeout)
+	return req.WithContext(ctx), cancel
+}
+
+func isEOF(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isConnClosed reports whether err indicates the peer closed the connection.
+func isConnClosed(err error) bool {
+	return isEOF(err) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// rewindBody resets the request body so the request can be sent again.
+func rewindBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.GetBody == nil {
+		return errors.New("request body cannot be rewound")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+// checkTrailer reports an error if the configured status trailer is present
+// and holds a value that is not considered successful.
+func (conn *Connection) checkTrailer(trailer http.Header) error {
+	if conn.trailerStatus == "" {
+		return nil
+	}
+	value := trailer.Get(conn.trailerStatus)
+	if value == "" {
+		return nil
+	}
+	for _, success := range conn.trailerSuccess {
+		if value == success {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s=%s", ErrTrailerStatus, conn.trailerStatus, value)
+}
+
+// isReportedFailure reports whether err is a failure the server signaled
+// after sending a success status.
+func isReportedFailure(err error) bool {
+	return errors.Is(err, ErrTrailerStatus) || errors.Is(err, ErrStreamStatus)
+}
+
 func closing(c io.Closer) {
 	err := c.Close()
 	if err != nil {
@@ -341,6 +2012,110 @@ func closing(c io.Closer) {
 	}
 }
 
+// eventBody returns the value of field to be sent as the raw request body.
+func eventBody(event *beat.Event, field string) (rawBody, error) {
+	value, err := event.GetValue(field)
+	if err != nil {
+		return nil, fmt.Errorf("body field %s: %v", field, err)
+	}
+	switch v := value.(type) {
+	case string:
+		return rawBody(v), nil
+	case []byte:
+		return rawBody(v), nil
+	}
+	return nil, fmt.Errorf("body field %s has unsupported type %T", field, value)
+}
+
+// objectBody applies on_non_object to raw if it is not a JSON object. It
+// returns false if the event is to be dropped.
+func (client *Client) objectBody(raw rawBody) (interface{}, bool) {
+	if client.onNonObject == "send_as_is" || isJSONObject(raw) {
+		return raw, true
+	}
+	if client.onNonObject == "drop" {
+		return nil, false
+	}
+	var value interface{} = string(raw)
+	if json.Valid(raw) {
+		value = json.RawMessage(raw)
+	}
+	return map[string]interface{}{client.nonObjectField: value}, true
+}
+
+func isJSONObject(b []byte) bool {
+	trimmed := bytes.TrimLeft(b, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(b)
+}
+
+// eventContentType returns the Content-Type for event's request, read from
+// content_type_field if set and falling back to content_type.
+func (client *Client) eventContentType(event *beat.Event) string {
+	if client.contentTypeField == "" {
+		return client.ContentType
+	}
+	if value, err := event.GetValue(client.contentTypeField); err == nil {
+		if s, ok := value.(string); ok && s != "" {
+			return s
+		}
+	}
+	return client.ContentType
+}
+
+// failureContext formats the configured log_failure_fields of event for
+// failure log messages.
+func (client *Client) failureContext(event *beat.Event) string {
+	return fieldsContext(client.logFields, event.GetValue)
+}
+
+// checkBodySize warns about a body larger than warn_body_bytes before it is
+// sent, naming the log_failure_fields of its first event.
+func (conn *Connection) checkBodySize(method, urlStr string, encoder bodyEncoder, body interface{}) {
+	raw, encoded := encoder.Sizes()
+	size := encoded
+	if conn.warnBodyRaw {
+		size = raw
+	}
+	if size <= conn.warnBodyBytes {
+		return
+	}
+	events, described := 1, ""
+	var first eventRaw
+	switch body := body.(type) {
+	case eventRaw:
+		first = body
+	case []eventRaw:
+		events = len(body)
+		if events > 0 {
+			first = body[0]
+		}
+	}
+	if first != nil && len(conn.logFields) > 0 {
+		var doc mapstr.M
+		if b, err := json.Marshal(first); err == nil && json.Unmarshal(b, &doc) == nil {
+			described = fieldsContext(conn.logFields, doc.GetValue)
+		}
+	}
+	logger.Warnf("Large request body: %s %s with %d events is %d bytes, %d before compression%s",
+		method, urlStr, events, encoded, raw, described)
+}
+
+// fieldsContext formats the values of fields for log messages.
+func fieldsContext(fields []string, getValue func(string) (interface{}, error)) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		value, err := getValue(field)
+		if err != nil {
+			value = "<missing>"
+		}
+		values[i] = fmt.Sprintf("%s=%v", field, value)
+	}
+	return " (" + strings.Join(values, ", ") + ")"
+}
+
 // this should ideally be in enc.go
 func makeEvent(v *beat.Event) map[string]json.RawMessage {
 	// Inline not supported,
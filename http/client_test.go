@@ -0,0 +1,496 @@
+package http
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// fakeDoer records the requests it receives and answers them with respond,
+// or with 200 OK if respond is nil.
+type fakeDoer struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	respond  func(req *http.Request) (*http.Response, error)
+}
+
+func (d *fakeDoer) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+	}
+	d.mu.Lock()
+	d.requests = append(d.requests, req)
+	d.bodies = append(d.bodies, string(body))
+	respond := d.respond
+	d.mu.Unlock()
+	if respond == nil {
+		return response(http.StatusOK, "{}"), nil
+	}
+	return respond(req)
+}
+
+func (d *fakeDoer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.requests)
+}
+
+func response(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// fakeBatch records how the client settled it.
+type fakeBatch struct {
+	events  []publisher.Event
+	acked   bool
+	dropped bool
+	retried []publisher.Event
+}
+
+func (b *fakeBatch) Events() []publisher.Event                { return b.events }
+func (b *fakeBatch) ACK()                                     { b.acked = true }
+func (b *fakeBatch) Drop()                                    { b.dropped = true }
+func (b *fakeBatch) Retry()                                   { b.retried = b.events }
+func (b *fakeBatch) RetryEvents(events []publisher.Event)     { b.retried = events }
+func (b *fakeBatch) SplitRetry() bool                         { return false }
+func (b *fakeBatch) Cancelled()                               {}
+func (b *fakeBatch) CancelledEvents(events []publisher.Event) {}
+func (b *fakeBatch) FreeEntries()                             {}
+
+// fakeObserver counts the events reported by the client.
+type fakeObserver struct {
+	mu                             sync.Mutex
+	acked, failed, dropped, events int
+}
+
+func (o *fakeObserver) NewBatch(n int)    { o.add(&o.events, n) }
+func (o *fakeObserver) Acked(n int)       { o.add(&o.acked, n) }
+func (o *fakeObserver) Failed(n int)      { o.add(&o.failed, n) }
+func (o *fakeObserver) Dropped(n int)     { o.add(&o.dropped, n) }
+func (o *fakeObserver) Duplicate()        {}
+func (o *fakeObserver) Cancelled(int)     {}
+func (o *fakeObserver) Split()            {}
+func (o *fakeObserver) ErrTooMany(int)    {}
+func (o *fakeObserver) WriteError(error)  {}
+func (o *fakeObserver) WriteBytes(int)    {}
+func (o *fakeObserver) ReadError(error)   {}
+func (o *fakeObserver) ReadBytes(int)     {}
+func (o *fakeObserver) add(p *int, n int) { o.mu.Lock(); *p += n; o.mu.Unlock() }
+
+func testEvents(n int) []publisher.Event {
+	events := make([]publisher.Event, n)
+	for i := range events {
+		events[i] = publisher.Event{Content: beat.Event{
+			Timestamp: time.Now(),
+			Fields:    mapstr.M{"message": fmt.Sprintf("event %d", i)},
+		}}
+	}
+	return events
+}
+
+// newTestClient creates a connected client sending its requests to doer.
+func newTestClient(t *testing.T, s ClientSettings, doer Doer) *Client {
+	t.Helper()
+	if s.URL == "" {
+		s.URL = "http://localhost:8080/ingest"
+	}
+	if s.Format == "" {
+		s.Format = "json"
+	}
+	s.Doer = doer
+	client, err := NewClient(s)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return client
+}
+
+func TestCloneUsesAllSettings(t *testing.T) {
+	doer := &fakeDoer{}
+	client := newTestClient(t, ClientSettings{
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"X-Tenant": "a"},
+		AddFields: mapstr.M{"env": "test"},
+	}, doer)
+	clone := client.Clone()
+	if err := clone.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	batch := &fakeBatch{events: testEvents(1)}
+	if err := clone.Publish(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if !batch.acked || doer.count() != 1 {
+		t.Fatalf("clone didn't publish through the fake: acked=%v requests=%d", batch.acked, doer.count())
+	}
+	req := doer.requests[0]
+	if req.Method != http.MethodPut || req.Header.Get("X-Tenant") != "a" {
+		t.Errorf("clone sent %s with X-Tenant %q", req.Method, req.Header.Get("X-Tenant"))
+	}
+	if !strings.Contains(doer.bodies[0], `"env":"test"`) {
+		t.Errorf("clone didn't add fields: %s", doer.bodies[0])
+	}
+}
+
+func TestClassify(t *testing.T) {
+	client := &Client{
+		retryOnStatus: []int{400},
+		dropOnStatus:  []int{409},
+		Connection:    Connection{successStatus: []int{404}},
+	}
+	failed := fmt.Errorf("failed")
+	tests := []struct {
+		status int
+		err    error
+		want   statusClass
+	}{
+		{200, nil, statusSuccess},
+		{204, nil, statusSuccess},
+		{404, failed, statusSuccess},
+		{400, failed, statusRetry},
+		{409, failed, statusDrop},
+		{500, failed, statusDrop},
+		{503, failed, statusRetry},
+		{302, failed, statusRetry},
+		// no response at all, e.g. signing, auth or the connection failed
+		{0, failed, statusRetry},
+		{0, ErrNotConnected, statusRetry},
+	}
+	for _, test := range tests {
+		if got := client.classify(test.status, test.err); got != test.want {
+			t.Errorf("classify(%d, %v) = %v, want %v", test.status, test.err, got, test.want)
+		}
+	}
+}
+
+// assertRetried checks that none of the events were acked and all of them
+// are retried.
+func assertRetried(t *testing.T, batch *fakeBatch, observer *fakeObserver, err error) {
+	t.Helper()
+	if err == nil {
+		t.Error("Publish returned no error")
+	}
+	if batch.acked || observer.acked > 0 {
+		t.Errorf("batch acked (%v) or events reported acked (%d)", batch.acked, observer.acked)
+	}
+	if len(batch.retried) != len(batch.events) {
+		t.Errorf("%d of %d events retried", len(batch.retried), len(batch.events))
+	}
+}
+
+func TestSigningFailureRetries(t *testing.T) {
+	for _, batchPublish := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batch_publish=%v", batchPublish), func(t *testing.T) {
+			doer := &fakeDoer{}
+			observer := &fakeObserver{}
+			client := newTestClient(t, ClientSettings{
+				BatchPublish:   batchPublish,
+				Observer:       observer,
+				SigningCommand: "false",
+				SigningHeader:  "X-Signature",
+			}, doer)
+			batch := &fakeBatch{events: testEvents(2)}
+			err := client.Publish(context.Background(), batch)
+			assertRetried(t, batch, observer, err)
+			if doer.count() != 0 {
+				t.Errorf("%d unsigned requests sent", doer.count())
+			}
+		})
+	}
+}
+
+func TestPublishConcurrently(t *testing.T) {
+	doer := doerFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if strings.Contains(string(body), `"event 3"`) {
+			return response(http.StatusServiceUnavailable, ""), nil
+		}
+		return response(http.StatusOK, "{}"), nil
+	})
+	for run := 0; run < 20; run++ {
+		client := newTestClient(t, ClientSettings{Concurrency: 4}, doer)
+		events := testEvents(20)
+		failed, err := client.publishConcurrently(events)
+		// the failure disconnects the client, so events published after it
+		// fail too
+		messages := make([]string, len(failed))
+		for i, event := range failed {
+			messages[i] = event.Content.Fields["message"].(string)
+		}
+		if !containsString(messages, "event 3") {
+			t.Fatalf("event 3 not among the failed events %v", messages)
+		}
+		for i := 1; i < len(failed); i++ {
+			if indexOf(events, failed[i]) < indexOf(events, failed[i-1]) {
+				t.Fatalf("failed events out of order: %v", messages)
+			}
+		}
+		// the error is the one of the first failed event, not of whichever
+		// request finished last
+		want := ErrNotConnected.Error()
+		if messages[0] == "event 3" {
+			want = "503"
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("got error %v for first failed %s", err, messages[0])
+		}
+	}
+}
+
+func indexOf(events []publisher.Event, event publisher.Event) int {
+	for i := range events {
+		if events[i].Content.Fields["message"] == event.Content.Fields["message"] {
+			return i
+		}
+	}
+	return -1
+}
+
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestBatchObserverCounts(t *testing.T) {
+	tests := map[string]struct {
+		respond                func(req *http.Request) (*http.Response, error)
+		acked, failed, dropped int
+	}{
+		"success": {
+			respond: func(*http.Request) (*http.Response, error) { return response(http.StatusOK, "{}"), nil },
+			acked:   3,
+		},
+		"transport error": {
+			respond: func(*http.Request) (*http.Response, error) { return nil, fmt.Errorf("connection refused") },
+			failed:  3,
+		},
+		"retried status": {
+			respond: func(*http.Request) (*http.Response, error) { return response(http.StatusServiceUnavailable, ""), nil },
+			failed:  3,
+		},
+		"rejected": {
+			respond: func(*http.Request) (*http.Response, error) { return response(http.StatusBadRequest, ""), nil },
+			dropped: 3,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			observer := &fakeObserver{}
+			client := newTestClient(t, ClientSettings{BatchPublish: true, Observer: observer}, &fakeDoer{respond: test.respond})
+			client.Publish(context.Background(), &fakeBatch{events: testEvents(3)})
+			if observer.acked != test.acked || observer.failed != test.failed || observer.dropped != test.dropped {
+				t.Errorf("acked %d, failed %d, dropped %d, want %d, %d, %d",
+					observer.acked, observer.failed, observer.dropped, test.acked, test.failed, test.dropped)
+			}
+		})
+	}
+}
+
+func TestDropEvents(t *testing.T) {
+	observer := &fakeObserver{}
+	s := ClientSettings{Observer: observer, drops: newDropSummary(time.Hour, nil)}
+	client := newTestClient(t, s, &fakeDoer{})
+	expired := eventsExpired.Value()
+
+	client.dropEvents("expired", 2)
+	client.dropEvents("body_field", 1)
+	if observer.dropped != 3 {
+		t.Errorf("observer counted %d dropped events, want 3", observer.dropped)
+	}
+	if got := eventsExpired.Value() - expired; got != 2 {
+		t.Errorf("expired counter increased by %d, want 2", got)
+	}
+	if counts := client.drops.totals; counts["expired"] != 2 || counts["body_field"] != 1 {
+		t.Errorf("summary totals %v", counts)
+	}
+}
+
+// newServerClient creates a connected client sending its requests over HTTP
+// to a test server running handler.
+func newServerClient(t *testing.T, s ClientSettings, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	s.URL = server.URL + "/ingest"
+	if s.Format == "" {
+		s.Format = "json"
+	}
+	client, err := NewClient(s)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCompressedContentLength(t *testing.T) {
+	type request struct {
+		length           int64
+		transferEncoding []string
+		encoding         string
+		read             int
+	}
+	requests := make(chan request, 1)
+	client := newServerClient(t, ClientSettings{BatchPublish: true, CompressionLevel: 5}, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.ContentLength, r.TransferEncoding, r.Header.Get("Content-Encoding"), len(body)}
+	})
+	batch := &fakeBatch{events: testEvents(20)}
+	if err := client.Publish(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+	if r.encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", r.encoding)
+	}
+	if r.length <= 0 || r.length != int64(r.read) {
+		t.Errorf("Content-Length = %d, body has %d bytes", r.length, r.read)
+	}
+	if len(r.transferEncoding) > 0 {
+		t.Errorf("Transfer-Encoding = %v, want none", r.transferEncoding)
+	}
+}
+
+func TestCompressionFlushStreams(t *testing.T) {
+	received := make(chan struct{})
+	events := make(chan int, 1)
+	client := newServerClient(t, ClientSettings{
+		BatchPublish:     true,
+		Format:           "json_lines",
+		CompressionLevel: 5,
+		CompressionFlush: true,
+		TransferEncoding: "chunked",
+	}, func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("gzip: %v", err)
+			return
+		}
+		// the line of an event is only ended by the separator before the
+		// next one, so events are decoded rather than read as lines
+		dec := json.NewDecoder(gz)
+		var event map[string]interface{}
+		if err := dec.Decode(&event); err != nil {
+			t.Errorf("reading the first event: %v", err)
+			return
+		}
+		close(received)
+		n := 1
+		for dec.Decode(&event) == nil {
+			n++
+		}
+		events <- n
+	})
+
+	// the encoder holds back the rest of the batch until the server got
+	// the first event
+	enc := client.encoder.(*gzipLinesEncoder)
+	flushes := 0
+	enc.count.flush = func() error {
+		if err := enc.gzip.Flush(); err != nil {
+			return err
+		}
+		if flushes++; flushes == 1 {
+			select {
+			case <-received:
+			case <-time.After(2 * time.Second):
+				return fmt.Errorf("the server did not receive the first event")
+			}
+		}
+		return nil
+	}
+
+	batch := &fakeBatch{events: testEvents(3)}
+	if err := client.Publish(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-events:
+		if n != 3 {
+			t.Errorf("server received %d events, want 3", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server received no request")
+	}
+	if !batch.acked {
+		t.Errorf("batch not acked, retried %d", len(batch.retried))
+	}
+}
+
+// publishUntilSettled publishes batch and its retries the way the pipeline
+// does, reconnecting after failures, up to limit attempts. It returns the
+// last batch.
+func publishUntilSettled(client *Client, batch *fakeBatch, limit int) *fakeBatch {
+	client.Publish(context.Background(), batch)
+	for attempt := 1; attempt < limit && len(batch.retried) > 0; attempt++ {
+		client.Connect()
+		batch = &fakeBatch{events: batch.retried}
+		client.Publish(context.Background(), batch)
+	}
+	return batch
+}
+
+func TestMaxRetriesAttempts(t *testing.T) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead_letter.ndjson")
+	tests := map[string]struct {
+		settings ClientSettings
+		attempts int
+		dropped  bool
+	}{
+		// the output re-queues the events, the pipeline decides
+		"re-queue": {ClientSettings{MaxRetries: 3}, 10, false},
+		// max_retries 3 means 1 attempt and 3 retries
+		"drop":        {ClientSettings{MaxRetries: 3, DropAfterMax: true}, 4, true},
+		"dead letter": {ClientSettings{MaxRetries: 3, DropAfterMax: true, OnFailure: "dead_letter", DeadLetterPath: deadLetterPath}, 4, true},
+		"no retries":  {ClientSettings{MaxRetries: 0, DropAfterMax: true}, 1, true},
+		"forever":     {ClientSettings{MaxRetries: -1, DropAfterMax: true}, 10, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			doer := failingDoer()
+			s := test.settings
+			s.BatchPublish = true
+			client := newTestClient(t, s, doer)
+			batch := publishUntilSettled(client, &fakeBatch{events: testEvents(2)}, 10)
+			if doer.count() != test.attempts {
+				t.Errorf("%d attempts, want %d", doer.count(), test.attempts)
+			}
+			if batch.dropped != test.dropped || test.dropped == (len(batch.retried) > 0) {
+				t.Errorf("dropped %v and retried %d events, want dropped %v", batch.dropped, len(batch.retried), test.dropped)
+			}
+		})
+	}
+
+	lines, err := ioutil.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(lines), "\n"); n != 2 {
+		t.Errorf("%d events dead-lettered, want 2", n)
+	}
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"encoding/json"
+
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+// coalesceEvents merges events of a batch that have the same values of all
+// client.coalesceFields into the first of them, which gets the sum of their
+// client.coalesceSum values. Events missing a key field are kept as they are,
+// a missing or non-numeric sum field counts as 1.
+func (client *Client) coalesceEvents(data []publisher.Event) []publisher.Event {
+	if len(client.coalesceFields) == 0 {
+		return data
+	}
+	type group struct {
+		index  int
+		merged int
+		sum    float64
+		float  bool
+	}
+	groups := make(map[string]*group, len(data))
+	kept := make([]publisher.Event, 0, len(data))
+	for _, event := range data {
+		key, ok := client.coalesceKey(&event)
+		if !ok {
+			kept = append(kept, event)
+			continue
+		}
+		n, isFloat := eventCount(&event, client.coalesceSum)
+		if g, ok := groups[key]; ok {
+			g.merged++
+			g.sum += n
+			g.float = g.float || isFloat
+			continue
+		}
+		groups[key] = &group{index: len(kept), sum: n, float: isFloat}
+		kept = append(kept, event)
+	}
+	coalesced := len(data) - len(kept)
+	if coalesced == 0 {
+		return data
+	}
+	for _, g := range groups {
+		if g.merged == 0 {
+			continue
+		}
+		event := &kept[g.index]
+		// the fields may be shared with other outputs
+		event.Content.Fields = event.Content.Fields.Clone()
+		if g.float {
+			event.Content.Fields.Put(client.coalesceSum, g.sum)
+		} else {
+			event.Content.Fields.Put(client.coalesceSum, int64(g.sum))
+		}
+	}
+	logger.Debugf("Coalesced %d events into %d.", len(data), len(kept))
+	eventsCoalesced.Add(int64(coalesced))
+	return kept
+}
+
+func (client *Client) coalesceKey(event *publisher.Event) (string, bool) {
+	values := make([]interface{}, len(client.coalesceFields))
+	for i, field := range client.coalesceFields {
+		value, err := event.Content.GetValue(field)
+		if err != nil {
+			return "", false
+		}
+		values[i] = value
+	}
+	key, err := json.Marshal(values)
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// eventCount returns the numeric value of field and whether it has a
+// fractional type, or 1 if the field is missing or not a number.
+func eventCount(event *publisher.Event, field string) (float64, bool) {
+	value, err := event.Content.GetValue(field)
+	if err != nil {
+		return 1, false
+	}
+	switch v := value.(type) {
+	case float32, float64:
+		f, _ := toFloat(v)
+		return f, true
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return float64(n), false
+		}
+		if f, err := v.Float64(); err == nil {
+			return f, true
+		}
+	}
+	if f, ok := toFloat(value); ok {
+		return f, false
+	}
+	return 1, false
+}
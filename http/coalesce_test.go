@@ -0,0 +1,50 @@
+package http
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestCoalesceEvents(t *testing.T) {
+	client := newTestClient(t, ClientSettings{CoalesceFields: []string{"host", "code"}, CoalesceSum: "count"}, &fakeDoer{})
+	var events []publisher.Event
+	for _, fields := range []mapstr.M{
+		{"host": "a", "code": 500, "count": 2},
+		{"host": "a", "code": 500},
+		{"host": "b", "code": 500, "count": 1.5},
+		{"host": "a"},
+		{"host": "b", "code": 500, "count": 2},
+	} {
+		events = append(events, publisher.Event{Content: beat.Event{Timestamp: time.Now(), Fields: fields}})
+	}
+
+	kept := client.coalesceEvents(events)
+	if len(kept) != 3 {
+		t.Fatalf("kept %d events, want 3", len(kept))
+	}
+	for i, want := range []interface{}{int64(3), 3.5, nil} {
+		got, _ := kept[i].Content.Fields.GetValue("count")
+		if got != want {
+			t.Errorf("event %d count = %#v, want %#v", i, got, want)
+		}
+	}
+	if host, _ := kept[2].Content.Fields.GetValue("host"); host != "a" {
+		t.Errorf("event without code not kept as is: %v", kept[2].Content.Fields)
+	}
+	// the fields may be shared with other outputs
+	if count, _ := events[0].Content.Fields.GetValue("count"); count != 2 {
+		t.Errorf("original event count changed to %v", count)
+	}
+}
+
+func TestCoalesceEventsDisabled(t *testing.T) {
+	client := newTestClient(t, ClientSettings{}, &fakeDoer{})
+	events := testEvents(3)
+	if kept := client.coalesceEvents(events); len(kept) != 3 {
+		t.Errorf("kept %d events without coalesce_fields, want 3", len(kept))
+	}
+}
@@ -1,35 +1,213 @@
 package http
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/elastic/elastic-agent-libs/mapstr"
 	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
 )
 
 type httpConfig struct {
 	Protocol         string            `config:"protocol"`
 	Path             string            `config:"path"`
-	Params           map[string]string `config:"parameters"`
+	Params           url.Values        `config:"parameters"`
 	Username         string            `config:"username"`
 	Password         string            `config:"password"`
+	UsernameFile     string            `config:"username_file"`
+	PasswordFile     string            `config:"password_file"`
+	CredentialReload time.Duration     `config:"credentials_reload_interval"`
 	ProxyURL         string            `config:"proxy_url"`
 	LoadBalance      bool              `config:"loadbalance"`
+	Fanout           bool              `config:"fanout"`
+	FanoutRequire    string            `config:"fanout_require"`
 	BatchPublish     bool              `config:"batch_publish"`
 	BatchSize        int               `config:"batch_size"`
 	CompressionLevel int               `config:"compression_level" validate:"min=0, max=9"`
+	NoCompressTypes  []string          `config:"compression_exclude_types"`
+	CompressionFlush bool              `config:"compression_flush"`
 	TLS              *tlscommon.Config `config:"tls"`
+	TLSReload        time.Duration     `config:"tls_reload_interval"`
+	TLSHandshake     time.Duration     `config:"tls_handshake_timeout"`
+	TLSServerName    string            `config:"tls_server_name"`
+	CertFingerprints []string          `config:"tls_cert_fingerprints"`
+	SessionTickets   *bool             `config:"tls_session_tickets"`
+	SPIFFE           spiffeConfig      `config:"spiffe"`
+	JWT              jwtConfig         `config:"jwt"`
+	OAuth2           oauth2Config      `config:"oauth2"`
 	MaxRetries       int               `config:"max_retries"`
+	DropAfterMax     bool              `config:"drop_after_max_retries"`
 	Timeout          time.Duration     `config:"timeout"`
+	HostTimeouts     []hostTimeout     `config:"host_timeouts"`
+	TimeoutMode      string            `config:"timeout_mode"`
 	Headers          map[string]string `config:"headers"`
 	ContentType      string            `config:"content_type"`
 	Backoff          backoff           `config:"backoff"`
 	Format           string            `config:"format"`
+	GroupSize        int               `config:"group_size"`
+	ProtoDescriptor  string            `config:"protobuf_descriptor"`
+	ProtoMessage     string            `config:"protobuf_message"`
+	Batch            batchConfig       `config:"batch"`
+	Pretty           bool              `config:"pretty"`
+	PrettyIndent     string            `config:"pretty_indent"`
+	PrettyHosts      []string          `config:"pretty_hosts"`
+	BatchSizeHeader  string            `config:"batch_size_header"`
+	BatchIDHeader    string            `config:"batch_id_header"`
+	RequestIDField   string            `config:"request_id_field"`
+	RequestIDHeader  string            `config:"request_id_header"`
+	RequestIDGen     bool              `config:"request_id_generate"`
+	SigningCommand   string            `config:"signing_command"`
+	SigningArgs      []string          `config:"signing_args"`
+	SigningHeader    string            `config:"signing_header"`
+	SigningTTL       time.Duration     `config:"signing_ttl"`
+	SigningTimeout   time.Duration     `config:"signing_timeout"`
+	DedupField       string            `config:"dedup_field"`
+	CoalesceFields   []string          `config:"coalesce_fields"`
+	CoalesceSum      string            `config:"coalesce_sum_field"`
+	DedupCheckURL    string            `config:"dedup_check_url"`
+	MaxEventAge      time.Duration     `config:"max_event_age"`
+	RetryBudget      time.Duration     `config:"retry_budget"`
+	MaxHosts         int               `config:"max_hosts_per_publish"`
+	AddFields        mapstr.M          `config:"add_fields"`
+	AddBeatMetadata  bool              `config:"add_beat_metadata"`
+	RenameFields     []renameField     `config:"rename_fields"`
+	CoerceFields     []coerceField     `config:"coerce_fields"`
+	CoerceFailure    string            `config:"on_coerce_failure"`
+	TransformScript  string            `config:"transform_script"`
+	ScriptFailure    string            `config:"on_script_failure"`
+	NumberFormat     string            `config:"number_format"`
+	MaskFields       []string          `config:"mask_fields"`
+	MaskMode         string            `config:"mask_mode"`
+	Flatten          bool              `config:"flatten"`
+	FlattenSep       string            `config:"flatten_separator"`
+	FlattenArrays    string            `config:"flatten_arrays"`
+	OnFailure        string            `config:"on_failure"`
+	RetryOnStatus    []int             `config:"retry_on_status"`
+	SuccessOnStatus  []int             `config:"success_on_status"`
+	DropOnStatus     []int             `config:"drop_on_status"`
+	DeadLetterPath   string            `config:"dead_letter_path"`
+	Method           string            `config:"method"`
+	MethodField      string            `config:"method_field"`
+	MethodMap        map[string]string `config:"method_map"`
+	SampleRate       float64           `config:"sample_rate" validate:"max=1"`
+	SampleField      string            `config:"sample_field"`
+	Concurrency      int               `config:"per_batch_concurrency" validate:"min=0"`
+	Ordered          bool              `config:"ordered"`
+	BodyField        string            `config:"body_field"`
+	OnNonObject      string            `config:"on_non_object"`
+	NonObjectField   string            `config:"non_object_field"`
+	ContentTypeField string            `config:"content_type_field"`
+	CaptureField     string            `config:"capture_response_field"`
+	CaptureIDField   string            `config:"capture_event_id_field"`
+	CapturePath      string            `config:"capture_response_path"`
+	LogFailureFields []string          `config:"log_failure_fields"`
+	ProxyProtocol    bool              `config:"send_proxy_protocol"`
+	AllowedHosts     []string          `config:"allowed_hosts"`
+	DeniedCIDRs      []string          `config:"denied_cidrs"`
+	Backpressure     pressureConfig    `config:"backpressure"`
+	Resolve          []resolveOverride `config:"resolve"`
+	NoKeepAlives     bool              `config:"disable_keep_alives"`
+	ShareTransport   bool              `config:"share_connections_on_clone"`
+	DataStreamPath   bool              `config:"data_stream_path"`
+	DynamicPath      string            `config:"dynamic_path"`
+	PathMissing      string            `config:"path_missing_default"`
+	PathLowercase    bool              `config:"path_lowercase"`
+	ClusterField     string            `config:"cluster_field"`
+	ClusterMap       map[string]string `config:"cluster_map"`
+	ClusterMissing   string            `config:"cluster_missing"`
+	TrailerStatus    string            `config:"trailer_status"`
+	TrailerSuccess   []string          `config:"trailer_success_values"`
+	TETrailers       bool              `config:"te_trailers"`
+	BatchHistograms  bool              `config:"batch_histograms"`
+	DropOnHostsDown  bool              `config:"drop_on_all_hosts_down"`
+	GlobalRateLimit  float64           `config:"global_rate_limit"`
+	DropLogInterval  time.Duration     `config:"drop_log_interval"`
+	DropNotifyURL    string            `config:"drop_notify_url"`
+	MaxPending       time.Duration     `config:"max_pending_duration"`
+	MinBatchSize     int               `config:"min_batch_size"`
+	FlushInterval    time.Duration     `config:"flush_interval"`
+	ShutdownTimeout  time.Duration     `config:"shutdown_timeout"`
+	RetryOnEOF       bool              `config:"retry_on_eof"`
+	Keepalive        keepaliveConfig   `config:"keepalive"`
+	HealthCheck      healthCheckConfig `config:"health_check"`
+	Response         responseConfig    `config:"response"`
+	StatefulHeader   statefulConfig    `config:"stateful_header"`
+	Bootstrap        bootstrapConfig   `config:"bootstrap"`
+	SelfTest         selfTestConfig    `config:"self_test"`
+	Prewarm          bool              `config:"prewarm_connections"`
+	PrettyBody       bool              `config:"debug_pretty_body"`
+	RequestDelay     time.Duration     `config:"inter_request_delay"`
+	SlowRequest      time.Duration     `config:"slow_request_threshold"`
+	WarnBodyBytes    int               `config:"warn_body_bytes"`
+	WarnBodySize     string            `config:"warn_body_size"`
+	TrailingNewline  bool              `config:"trailing_newline"`
+	ContentMD5       bool              `config:"content_md5"`
+	MaxConnsPerHost  int               `config:"max_connections_per_host"`
+	TransferEncoding string            `config:"transfer_encoding"`
+	ChunkThreshold   int               `config:"chunk_threshold_bytes"`
+	HTTPVersion      string            `config:"http_version"`
+}
+
+// batchConfig overrides the format's default framing of batch bodies.
+type batchConfig struct {
+	Prefix    *string `config:"prefix"`
+	Separator *string `config:"separator"`
+	Suffix    *string `config:"suffix"`
+	// CountField adds the number of events to the object opened by Prefix.
+	CountField string `config:"count_field"`
+}
+
+type keepaliveConfig struct {
+	Interval time.Duration `config:"interval"`
+	Method   string        `config:"method"`
+	Path     string        `config:"path"`
+}
+
+// healthCheckConfig configures a probe sent every interval, whether or not
+// events are published. Path defaults to the publish path.
+type healthCheckConfig struct {
+	Interval time.Duration `config:"interval"`
+	Method   string        `config:"method"`
+	Path     string        `config:"path"`
+	// EmptyBody sends an empty body with Content-Length: 0, which needs a
+	// method that carries a body.
+	EmptyBody bool `config:"empty_body"`
+}
+
+// responseConfig configures how response bodies are read.
+type responseConfig struct {
+	// Stream reads the body line by line until a line starting with
+	// TerminalMarker, instead of waiting for the server to close it.
+	Stream         bool   `config:"stream"`
+	TerminalMarker string `config:"terminal_marker"`
+	// SuccessValues are the accepted values following TerminalMarker, any
+	// value is accepted if empty.
+	SuccessValues []string `config:"success_values"`
+	// RejectedField or AcceptedField of a JSON response to a batch report
+	// how many of its events were rejected or accepted. Batches with
+	// rejected events are retried up to RejectedRetries times.
+	AcceptedField   string `config:"accepted_field"`
+	RejectedField   string `config:"rejected_field"`
+	RejectedRetries int    `config:"rejected_retries"`
+}
+
+// hostTimeout overrides the request timeout of one of the hosts.
+type hostTimeout struct {
+	Host    string        `config:"host" validate:"required"`
+	Timeout time.Duration `config:"timeout" validate:"required"`
 }
 
 type backoff struct {
 	Init time.Duration
 	Max  time.Duration
+	// ResetOnSuccess resets the delay after every successful publish.
+	ResetOnSuccess bool `config:"reset_on_success"`
 }
 
 var (
@@ -40,18 +218,71 @@ var (
 		ProxyURL:         "",
 		Username:         "",
 		Password:         "",
+		CredentialReload: time.Minute,
 		BatchPublish:     false,
 		BatchSize:        2048,
 		Timeout:          90 * time.Second,
+		TLSHandshake:     10 * time.Second,
+		SPIFFE:           spiffeConfig{Timeout: 30 * time.Second},
+		JWT:              jwtConfig{Algorithm: "RS256", TTL: 5 * time.Minute},
 		CompressionLevel: 0,
 		TLS:              nil,
 		MaxRetries:       3,
 		LoadBalance:      false,
 		Backoff: backoff{
-			Init: 1 * time.Second,
-			Max:  60 * time.Second,
+			Init:           1 * time.Second,
+			Max:            60 * time.Second,
+			ResetOnSuccess: true,
+		},
+		Format:           "json",
+		GroupSize:        10,
+		BatchSizeHeader:  "X-Batch-Size",
+		BatchIDHeader:    "X-Batch-Id",
+		RequestIDHeader:  "X-Request-Id",
+		Method:           "POST",
+		OnFailure:        "drop",
+		OnNonObject:      "send_as_is",
+		NonObjectField:   "message",
+		DropLogInterval:  30 * time.Second,
+		ClusterMissing:   "default",
+		FanoutRequire:    "all",
+		NumberFormat:     "default",
+		MaskMode:         "redact",
+		CoerceFailure:    "keep",
+		ScriptFailure:    "passthrough",
+		FlattenSep:       ".",
+		FlattenArrays:    "keep",
+		CaptureIDField:   "event.id",
+		TransferEncoding: "identity",
+		ChunkThreshold:   1 << 20,
+		HTTPVersion:      "1.1",
+		PrettyIndent:     "  ",
+		TimeoutMode:      "client",
+		WarnBodySize:     "encoded",
+		Keepalive: keepaliveConfig{
+			Method: "HEAD",
+		},
+		HealthCheck: healthCheckConfig{
+			Method: "GET",
+		},
+		Bootstrap: bootstrapConfig{
+			Method: "POST",
 		},
-		Format: "json",
+		Response: responseConfig{
+			RejectedRetries: 3,
+		},
+		SelfTest: selfTestConfig{
+			Body:    `{"message":"beats http output self test"}`,
+			Require: "any",
+		},
+		SigningHeader:   "X-Signature",
+		SigningTTL:      0,
+		SigningTimeout:  10 * time.Second,
+		TrailerSuccess:  []string{"0"},
+		MaxPending:      5 * time.Minute,
+		FlushInterval:   time.Second,
+		ShutdownTimeout: 5 * time.Second,
+		SampleRate:      1,
 	}
 )
 
@@ -61,9 +292,399 @@ func (c *httpConfig) Validate() error {
 			return err
 		}
 	}
-	if c.Format != "json" && c.Format != "json_lines" {
+	switch c.Format {
+	case "json", "json_lines":
+	case "ndjson_grouped":
+		if c.GroupSize <= 0 {
+			return fmt.Errorf("group_size must be greater than 0: %d", c.GroupSize)
+		}
+	case "protobuf":
+		if c.ProtoDescriptor == "" || c.ProtoMessage == "" {
+			return fmt.Errorf("protobuf_descriptor and protobuf_message must be set when format is protobuf")
+		}
+		if c.CompressionLevel != 0 {
+			return fmt.Errorf("compression_level is not supported with format protobuf")
+		}
+	default:
 		return fmt.Errorf("Unsupported config option format: %s", c.Format)
 	}
+	if err := c.validateConflicts(); err != nil {
+		return err
+	}
+	for _, status := range append(c.RetryOnStatus, c.DropOnStatus...) {
+		if status < 300 || status > 599 {
+			return fmt.Errorf("invalid status code in retry_on_status or drop_on_status: %d", status)
+		}
+	}
+	for _, status := range c.RetryOnStatus {
+		if containsStatus(c.DropOnStatus, status) {
+			return fmt.Errorf("status %d cannot be in both retry_on_status and drop_on_status", status)
+		}
+	}
+	for _, status := range c.SuccessOnStatus {
+		if status < 300 || status > 599 {
+			return fmt.Errorf("invalid status code in success_on_status: %d", status)
+		}
+		if containsStatus(c.RetryOnStatus, status) || containsStatus(c.DropOnStatus, status) {
+			return fmt.Errorf("status %d cannot be in both success_on_status and retry_on_status or drop_on_status", status)
+		}
+	}
+	switch c.TransferEncoding {
+	case "identity", "chunked":
+	case "auto":
+		if c.ChunkThreshold <= 0 {
+			return fmt.Errorf("chunk_threshold_bytes must be greater than 0: %d", c.ChunkThreshold)
+		}
+	default:
+		return fmt.Errorf("Unsupported config option transfer_encoding: %s", c.TransferEncoding)
+	}
+	if c.CompressionFlush && (c.CompressionLevel == 0 || c.TransferEncoding != "chunked") {
+		// only chunked bodies are sent while they are encoded
+		return fmt.Errorf("compression_flush requires compression_level above 0 and transfer_encoding chunked")
+	}
+	if c.Pretty {
+		if c.Format != "json" {
+			return fmt.Errorf("pretty can only be used with format json")
+		}
+		if c.PrettyIndent == "" || strings.Trim(c.PrettyIndent, " \t") != "" {
+			return fmt.Errorf("pretty_indent must consist of spaces and tabs")
+		}
+	}
+	if c.TimeoutMode != "client" && c.TimeoutMode != "context" {
+		return fmt.Errorf("Unsupported config option timeout_mode: %s", c.TimeoutMode)
+	}
+	if c.HTTPVersion != "1.0" && c.HTTPVersion != "1.1" {
+		return fmt.Errorf("Unsupported config option http_version: %s", c.HTTPVersion)
+	}
+	if c.Batch.CountField != "" && !strings.HasPrefix(c.batchFraming().Prefix, "{") {
+		return fmt.Errorf("batch.prefix must open a JSON object when batch.count_field is used")
+	}
+	if c.ClusterField != "" && len(c.ClusterMap) == 0 {
+		return fmt.Errorf("cluster_map must be set when cluster_field is used")
+	}
+	for name, base := range c.ClusterMap {
+		if u, err := url.Parse(base); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("cluster_map entry %s is not a valid URL: %s", name, base)
+		}
+	}
+	if c.ClusterMissing != "default" && c.ClusterMissing != "drop" {
+		return fmt.Errorf("Unsupported config option cluster_missing: %s", c.ClusterMissing)
+	}
+	switch c.FanoutRequire {
+	case "any", "all", "quorum":
+	default:
+		return fmt.Errorf("Unsupported config option fanout_require: %s", c.FanoutRequire)
+	}
+	for _, coerce := range c.CoerceFields {
+		switch coerce.Type {
+		case "string", "int", "float", "bool":
+		default:
+			return fmt.Errorf("Unsupported type in coerce_fields: %s", coerce.Type)
+		}
+	}
+	if c.CoerceFailure != "keep" && c.CoerceFailure != "drop" {
+		return fmt.Errorf("Unsupported config option on_coerce_failure: %s", c.CoerceFailure)
+	}
+	if c.TransformScript != "" {
+		if _, err := newTransformScript(c.TransformScript); err != nil {
+			return err
+		}
+	}
+	if c.ScriptFailure != "passthrough" && c.ScriptFailure != "drop" {
+		return fmt.Errorf("Unsupported config option on_script_failure: %s", c.ScriptFailure)
+	}
+	switch c.MaskMode {
+	case "redact", "hash":
+	default:
+		return fmt.Errorf("Unsupported config option mask_mode: %s", c.MaskMode)
+	}
+	if c.FlattenArrays != "keep" && c.FlattenArrays != "index" {
+		return fmt.Errorf("Unsupported config option flatten_arrays: %s", c.FlattenArrays)
+	}
+	if c.Flatten && c.FlattenSep == "" {
+		return fmt.Errorf("flatten_separator must be set when flatten is used")
+	}
+	switch c.NumberFormat {
+	case "default", "decimal":
+	default:
+		return fmt.Errorf("Unsupported config option number_format: %s", c.NumberFormat)
+	}
+	switch c.OnNonObject {
+	case "send_as_is", "drop":
+	case "wrap":
+		if c.NonObjectField == "" {
+			return fmt.Errorf("non_object_field must be set when on_non_object is wrap")
+		}
+	default:
+		return fmt.Errorf("Unsupported config option on_non_object: %s", c.OnNonObject)
+	}
+	switch c.OnFailure {
+	case "drop", "retry":
+	case "dead_letter":
+		if c.DeadLetterPath == "" {
+			return fmt.Errorf("dead_letter_path must be set when on_failure is dead_letter")
+		}
+	default:
+		return fmt.Errorf("Unsupported config option on_failure: %s", c.OnFailure)
+	}
+	if c.Method == "" {
+		return fmt.Errorf("method must not be empty")
+	}
+	if c.MethodField != "" && len(c.MethodMap) == 0 {
+		return fmt.Errorf("method_map must be set when method_field is used")
+	}
+	for value, method := range c.MethodMap {
+		if method == "" {
+			return fmt.Errorf("method_map entry %s must not be empty", value)
+		}
+	}
+	if c.SampleRate <= 0 {
+		return fmt.Errorf("sample_rate must be greater than 0: %v", c.SampleRate)
+	}
+	if c.SigningCommand != "" && c.SigningHeader == "" {
+		return fmt.Errorf("signing_header must be set when signing_command is used")
+	}
+	if c.TrailerStatus != "" && len(c.TrailerSuccess) == 0 {
+		return fmt.Errorf("trailer_success_values must not be empty when trailer_status is used")
+	}
+	if h := c.StatefulHeader; h.RequestHeader != "" || h.ResponseHeader != "" || h.ResponseField != "" {
+		if h.RequestHeader == "" {
+			return fmt.Errorf("stateful_header.request_header must be set")
+		}
+		if (h.ResponseHeader == "") == (h.ResponseField == "") {
+			return fmt.Errorf("stateful_header needs either response_header or response_field")
+		}
+	}
+	if b := c.Bootstrap; b.Path != "" || b.ResponseField != "" || b.RequestHeader != "" {
+		if b.ResponseField == "" || b.RequestHeader == "" {
+			return fmt.Errorf("bootstrap.response_field and bootstrap.request_header must be set")
+		}
+	}
+	if (c.Response.AcceptedField != "" || c.Response.RejectedField != "") && !c.BatchPublish {
+		return fmt.Errorf("response.accepted_field and response.rejected_field require batch_publish")
+	}
+	switch c.SelfTest.Require {
+	case "any", "all", "none":
+	default:
+		return fmt.Errorf("Unsupported config option self_test.require: %s", c.SelfTest.Require)
+	}
+	if c.CredentialReload < 0 {
+		return fmt.Errorf("credentials_reload_interval must not be negative: %v", c.CredentialReload)
+	}
+	if c.Backpressure.QueueDepth < 0 {
+		return fmt.Errorf("backpressure.queue_depth must not be negative: %d", c.Backpressure.QueueDepth)
+	}
+	if c.Backpressure.Latency < 0 {
+		return fmt.Errorf("backpressure.latency must not be negative: %v", c.Backpressure.Latency)
+	}
+	if c.Response.RejectedRetries < 0 {
+		return fmt.Errorf("response.rejected_retries must not be negative: %d", c.Response.RejectedRetries)
+	}
+	if c.Response.Stream && c.Response.TerminalMarker == "" {
+		return fmt.Errorf("response.terminal_marker must be set when response.stream is used")
+	}
+	if c.RequestDelay < 0 {
+		return fmt.Errorf("inter_request_delay must not be negative: %v", c.RequestDelay)
+	}
+	if c.SlowRequest < 0 {
+		return fmt.Errorf("slow_request_threshold must not be negative: %v", c.SlowRequest)
+	}
+	if c.WarnBodyBytes < 0 {
+		return fmt.Errorf("warn_body_bytes must not be negative: %d", c.WarnBodyBytes)
+	}
+	if c.WarnBodySize != "encoded" && c.WarnBodySize != "raw" {
+		return fmt.Errorf("Unsupported config option warn_body_size: %s", c.WarnBodySize)
+	}
+	if c.MaxConnsPerHost < 0 {
+		return fmt.Errorf("max_connections_per_host must not be negative: %d", c.MaxConnsPerHost)
+	}
+	if c.MinBatchSize < 0 {
+		return fmt.Errorf("min_batch_size must not be negative: %d", c.MinBatchSize)
+	}
+	if c.MinBatchSize > 0 && c.FlushInterval <= 0 {
+		return fmt.Errorf("flush_interval must be greater than 0 when min_batch_size is used")
+	}
+	if _, err := newAddressGuard(c.AllowedHosts, c.DeniedCIDRs); err != nil {
+		return err
+	}
+	for _, override := range c.Resolve {
+		if net.ParseIP(override.Address) == nil {
+			return fmt.Errorf("resolve address of %s must be an IP address: %s", override.Host, override.Address)
+		}
+	}
+	for _, override := range c.HostTimeouts {
+		if override.Timeout <= 0 {
+			return fmt.Errorf("host_timeouts timeout of %s must be greater than 0: %v", override.Host, override.Timeout)
+		}
+	}
+	if (c.RequestIDField != "" || c.RequestIDGen) && c.RequestIDHeader == "" {
+		return fmt.Errorf("request_id_header must be set when request_id_field or request_id_generate is used")
+	}
+	if len(c.CoalesceFields) > 0 && c.CoalesceSum == "" {
+		return fmt.Errorf("coalesce_sum_field must be set when coalesce_fields is used")
+	}
+	if c.DedupCheckURL != "" && c.DedupField == "" {
+		return fmt.Errorf("dedup_field must be set when dedup_check_url is used")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative: %v", c.ShutdownTimeout)
+	}
+	if c.DropLogInterval <= 0 {
+		return fmt.Errorf("drop_log_interval must be greater than 0: %v", c.DropLogInterval)
+	}
+	if c.GlobalRateLimit < 0 {
+		return fmt.Errorf("global_rate_limit must not be negative: %v", c.GlobalRateLimit)
+	}
+	if c.DropOnHostsDown && c.MaxPending <= 0 {
+		return fmt.Errorf("max_pending_duration must be positive when drop_on_all_hosts_down is enabled")
+	}
+	if c.Keepalive.Interval < 0 {
+		return fmt.Errorf("keepalive.interval must not be negative: %v", c.Keepalive.Interval)
+	}
+	if c.HealthCheck.Interval < 0 {
+		return fmt.Errorf("health_check.interval must not be negative: %v", c.HealthCheck.Interval)
+	}
+	if c.HealthCheck.EmptyBody {
+		switch c.HealthCheck.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			return fmt.Errorf("health_check.empty_body requires method POST, PUT or PATCH, not %s", c.HealthCheck.Method)
+		}
+	}
+	if c.MaxEventAge < 0 {
+		return fmt.Errorf("max_event_age must not be negative: %v", c.MaxEventAge)
+	}
+	if c.RetryBudget < 0 {
+		return fmt.Errorf("retry_budget must not be negative: %v", c.RetryBudget)
+	}
+	if c.MaxHosts < 0 {
+		return fmt.Errorf("max_hosts_per_publish must not be negative: %d", c.MaxHosts)
+	}
+	for _, fingerprint := range c.CertFingerprints {
+		if b, err := hex.DecodeString(normalizeFingerprint(fingerprint)); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid SHA-256 fingerprint in tls_cert_fingerprints: %s", fingerprint)
+		}
+	}
+	if c.JWT.PrivateKey != "" && c.JWT.TTL <= 0 {
+		return fmt.Errorf("jwt.ttl must be greater than 0: %v", c.JWT.TTL)
+	}
+	if c.OAuth2.TokenURL != "" && c.OAuth2.ClientID == "" {
+		return fmt.Errorf("oauth2.client_id must be set when oauth2.token_url is used")
+	}
+	if c.SPIFFE.Socket != "" && c.SPIFFE.Timeout <= 0 {
+		return fmt.Errorf("spiffe.timeout must be greater than 0: %v", c.SPIFFE.Timeout)
+	}
+	if c.TLSHandshake < 0 {
+		return fmt.Errorf("tls_handshake_timeout must not be negative: %v", c.TLSHandshake)
+	}
+	if c.TLSReload < 0 {
+		return fmt.Errorf("tls_reload_interval must not be negative: %v", c.TLSReload)
+	}
+	if c.SigningTTL < 0 {
+		return fmt.Errorf("signing_ttl must not be negative: %v", c.SigningTTL)
+	}
+	if c.SigningTimeout < 0 {
+		return fmt.Errorf("signing_timeout must not be negative: %v", c.SigningTimeout)
+	}
 
 	return nil
 }
+
+// webSocket reports whether events are streamed over WebSocket connections.
+func (c *httpConfig) webSocket() bool {
+	return c.Protocol == "ws" || c.Protocol == "wss"
+}
+
+// timeout returns the request timeout of host, as listed in hosts.
+func (c *httpConfig) timeout(host string) time.Duration {
+	for _, override := range c.HostTimeouts {
+		if override.Host == host {
+			return override.Timeout
+		}
+	}
+	return c.Timeout
+}
+
+// indent returns the indentation of JSON bodies sent to host, "" if they are
+// not pretty-printed.
+func (c *httpConfig) indent(host string) string {
+	if !c.Pretty || len(c.PrettyHosts) > 0 && !containsString(c.PrettyHosts, host) {
+		return ""
+	}
+	return c.PrettyIndent
+}
+
+// batchFraming returns the configured batch framing, falling back to the
+// format's default for options not set.
+func (c *httpConfig) batchFraming() batchFraming {
+	framing := defaultBatchFraming(c.Format)
+	if c.Batch.Prefix != nil {
+		framing.Prefix = *c.Batch.Prefix
+	}
+	if c.Batch.Separator != nil {
+		framing.Separator = *c.Batch.Separator
+	}
+	if c.Batch.Suffix != nil {
+		framing.Suffix = *c.Batch.Suffix
+	}
+	framing.CountField = c.Batch.CountField
+	if c.TrailingNewline && !strings.HasSuffix(framing.Suffix, "\n") {
+		framing.Suffix += "\n"
+	}
+	return framing
+}
+
+// groupSize returns the number of events per line, which is only used with
+// format ndjson_grouped.
+func (c *httpConfig) groupSize() int {
+	if c.Format != "ndjson_grouped" {
+		return 0
+	}
+	return c.GroupSize
+}
+
+// validateConflicts reports options that are set together but cannot be
+// combined.
+func (c *httpConfig) validateConflicts() error {
+	conflicts := []struct {
+		option, other string
+		conflict      bool
+	}{
+		{"body_field", "batch_publish", c.BodyField != "" && c.BatchPublish},
+		{"content_type_field", "batch_publish", c.ContentTypeField != "" && c.BatchPublish},
+		{"capture_response_field", "batch_publish", c.CaptureField != "" && c.BatchPublish},
+		{"request_id_field", "batch_publish", c.RequestIDField != "" && c.BatchPublish},
+		{"request_id_generate", "batch_publish", c.RequestIDGen && c.BatchPublish},
+		{"per_batch_concurrency", "batch_publish", c.Concurrency > 1 && c.BatchPublish},
+		{"fanout", "loadbalance", c.Fanout && c.LoadBalance},
+		{"proxy_url", "allowed_hosts or denied_cidrs", c.ProxyURL != "" && (len(c.AllowedHosts) > 0 || len(c.DeniedCIDRs) > 0)},
+		{"max_hosts_per_publish", "fanout", c.MaxHosts > 0 && c.Fanout},
+		{"jwt", "username", c.JWT.PrivateKey != "" && c.Username != ""},
+		{"oauth2", "username", c.OAuth2.TokenURL != "" && c.Username != ""},
+		{"username_file", "username", c.UsernameFile != "" && c.Username != ""},
+		{"password_file", "password", c.PasswordFile != "" && c.Password != ""},
+		{"jwt", "password_file", c.JWT.PrivateKey != "" && c.PasswordFile != ""},
+		{"oauth2", "password_file", c.OAuth2.TokenURL != "" && c.PasswordFile != ""},
+		{"oauth2", "jwt", c.OAuth2.TokenURL != "" && c.JWT.PrivateKey != ""},
+		{"min_batch_size", "fanout", c.MinBatchSize > 0 && c.Fanout},
+		{"prewarm_connections", "disable_keep_alives", c.Prewarm && c.NoKeepAlives},
+		{"dynamic_path", "data_stream_path", c.DynamicPath != "" && c.DataStreamPath},
+		{"spiffe.socket", "tls_reload_interval", c.SPIFFE.Socket != "" && c.TLSReload > 0},
+		{"tls_server_name", "tls_reload_interval", c.TLSServerName != "" && c.TLSReload > 0},
+		{"tls_cert_fingerprints", "tls_reload_interval", len(c.CertFingerprints) > 0 && c.TLSReload > 0},
+		{"tls_session_tickets", "tls_reload_interval", c.SessionTickets != nil && c.TLSReload > 0},
+		{"spiffe.socket", "tls.certificate", c.SPIFFE.Socket != "" && c.TLS != nil && c.TLS.Certificate.Certificate != ""},
+		{"protocol ws", "batch_publish", c.webSocket() && c.BatchPublish},
+		{"compression_flush", "content_md5", c.CompressionFlush && c.ContentMD5},
+		{"compression_flush", "signing_command", c.CompressionFlush && c.SigningCommand != ""},
+		{"http_version 1.0", "transfer_encoding chunked or auto", c.HTTPVersion == "1.0" && c.TransferEncoding != "identity"},
+		{"http_version 1.0", "prewarm_connections", c.HTTPVersion == "1.0" && c.Prewarm},
+		{"http_version 1.0", "protocol ws", c.HTTPVersion == "1.0" && c.webSocket()},
+	}
+	for _, check := range conflicts {
+		if check.conflict {
+			return fmt.Errorf("%s cannot be used with %s", check.option, check.other)
+		}
+	}
+	return nil
+}
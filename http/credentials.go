@@ -0,0 +1,82 @@
+package http
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileCredentials reads the basic auth username and password from files, so
+// rotated secrets are used without a restart. The files are read again at
+// most once per interval, when a request is sent.
+type fileCredentials struct {
+	usernameFile string
+	passwordFile string
+	interval     time.Duration
+
+	mu       sync.Mutex
+	username string
+	password string
+	checked  time.Time
+}
+
+// newFileCredentials reads the files once, failing if any can't be read.
+// An empty file name keeps the configured value of that credential.
+func newFileCredentials(usernameFile, passwordFile string, interval time.Duration) (*fileCredentials, error) {
+	c := &fileCredentials{usernameFile: usernameFile, passwordFile: passwordFile, interval: interval}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.checked = time.Now()
+	return c, nil
+}
+
+// get returns the current credentials, falling back to username and
+// password for those not read from a file.
+func (c *fileCredentials) get(username, password string) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= c.interval {
+		c.checked = time.Now()
+		if err := c.load(); err != nil {
+			logger.Warnf("Failed to reload credentials, keeping the previous ones: %v", err)
+		}
+	}
+	if c.usernameFile != "" {
+		username = c.username
+	}
+	if c.passwordFile != "" {
+		password = c.password
+	}
+	return username, password
+}
+
+// load reads both files before replacing either credential, so a failed
+// read never pairs a new username with an old password.
+func (c *fileCredentials) load() error {
+	username, err := readSecret(c.usernameFile)
+	if err != nil {
+		return err
+	}
+	password, err := readSecret(c.passwordFile)
+	if err != nil {
+		return err
+	}
+	c.username, c.password = username, password
+	return nil
+}
+
+// readSecret returns the contents of file without trailing line breaks, or
+// "" if file is "".
+func readSecret(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,56 @@
+package http
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+// deadLetterWriter appends events that could not be published to a file,
+// one JSON document per line.
+type deadLetterWriter struct {
+	mu   sync.Mutex
+	path string
+}
+
+type deadLetterEntry struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Reason    string    `json:"reason"`
+	Event     eventRaw  `json:"event"`
+}
+
+func newDeadLetterWriter(path string) *deadLetterWriter {
+	return &deadLetterWriter{path: path}
+}
+
+// Write appends events with the reason they could not be published. Errors
+// are logged, as there is nothing left to fall back to.
+func (w *deadLetterWriter) Write(events []publisher.Event, reason error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logger.Errorf("Failed to open dead letter file, dropping %d events: %v", len(events), err)
+		return
+	}
+	defer closing(f)
+
+	enc := json.NewEncoder(f)
+	now := time.Now().UTC()
+	for i := range events {
+		entry := deadLetterEntry{
+			Timestamp: now,
+			Reason:    reason.Error(),
+			Event:     makeEvent(&events[i].Content),
+		}
+		if err := enc.Encode(entry); err != nil {
+			logger.Errorf("Failed to write dead letter event: %v", err)
+			return
+		}
+	}
+	eventsDeadLettered.Add(int64(len(events)))
+}
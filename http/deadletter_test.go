@@ -0,0 +1,47 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeadLetterWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letter.ndjson")
+	w := newDeadLetterWriter(path)
+	w.Write(testEvents(2), errors.New("400 Bad Request"))
+	w.Write(testEvents(1), errors.New("413 Request Entity Too Large"))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []deadLetterEntry
+	for lines := bufio.NewScanner(f); lines.Scan(); {
+		var entry deadLetterEntry
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q: %v", lines.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d entries, want 3 appended", len(entries))
+	}
+	for i, want := range []struct{ reason, message string }{
+		{"400 Bad Request", `"event 0"`},
+		{"400 Bad Request", `"event 1"`},
+		{"413 Request Entity Too Large", `"event 0"`},
+	} {
+		entry := entries[i]
+		if entry.Reason != want.reason || string(entry.Event["message"]) != want.message {
+			t.Errorf("entry %d = %s %s, want %s %s", i, entry.Reason, entry.Event["message"], want.reason, want.message)
+		}
+		if entry.Timestamp.IsZero() {
+			t.Errorf("entry %d has no timestamp", i)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+// dropStored asks dedup_check_url which dedup_field values of retried
+// events the server stored already, for example because the connection
+// dropped before the response to the previous attempt was read, and drops
+// those events. If the check fails all events are sent again.
+func (client *Client) dropStored(data []publisher.Event) []publisher.Event {
+	if client.dedupCheckURL == "" {
+		return data
+	}
+	var keys []string
+	for i := range data {
+		if eventRetries(&data[i]) == 0 {
+			continue
+		}
+		if value, err := data[i].Content.GetValue(client.dedupField); err == nil {
+			keys = append(keys, fmt.Sprint(value))
+		}
+	}
+	if len(keys) == 0 {
+		return data
+	}
+	stored, err := client.checkStored(keys)
+	if err != nil {
+		logger.Warnf("Failed to check for stored events at %s: %v", client.dedupCheckURL, err)
+		return data
+	}
+	if len(stored) == 0 {
+		return data
+	}
+	kept := make([]publisher.Event, 0, len(data))
+	for i := range data {
+		if eventRetries(&data[i]) > 0 {
+			if value, err := data[i].Content.GetValue(client.dedupField); err == nil {
+				if _, ok := stored[fmt.Sprint(value)]; ok {
+					continue
+				}
+			}
+		}
+		kept = append(kept, data[i])
+	}
+	if dropped := len(data) - len(kept); dropped > 0 {
+		logger.Debugf("Dropped %d retried events the server stored already.", dropped)
+		client.dropEvents("duplicate", dropped)
+	}
+	return kept
+}
+
+// checkStored posts keys as a JSON array to dedup_check_url, which responds
+// with the array of keys it stored. The check doesn't count against
+// max_connections_per_host: dedup_check_url may be served by another host,
+// and every worker checks at most once before taking a slot for its batch.
+func (client *Client) checkStored(keys []string) (map[string]struct{}, error) {
+	body, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, client.dedupCheckURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.authorize(req, client.headers); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, resp, err := client.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	var storedKeys []string
+	if err := json.Unmarshal(resp, &storedKeys); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	stored := make(map[string]struct{}, len(storedKeys))
+	for _, key := range storedKeys {
+		stored[key] = struct{}{}
+	}
+	return stored, nil
+}
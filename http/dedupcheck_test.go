@@ -0,0 +1,35 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckStored(t *testing.T) {
+	doer := &fakeDoer{respond: func(*http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `["a"]`), nil
+	}}
+	s := ClientSettings{DedupField: "id", DedupCheckURL: "http://localhost:8080/stored", connSlots: make(chan struct{}, 1)}
+	client := newTestClient(t, s, doer)
+	client.oauth2 = &oauth2Source{token: "secret", refresh: time.Now().Add(time.Hour)}
+	// all slots are taken by a request in flight
+	client.connSlots <- struct{}{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stored, err := client.checkStored([]string{"a", "b"})
+		if _, ok := stored["a"]; err != nil || len(stored) != 1 || !ok {
+			t.Errorf("got %v, %v, want a stored", stored, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the check waited for a connection slot")
+	}
+	if got := doer.requests[0].Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the bearer token", got)
+	}
+}
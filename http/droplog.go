@@ -0,0 +1,107 @@
+package http
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// dropSummary counts dropped events by reason, instead of logging every
+// drop. Every drop logs the totals through a rate-limited logger, which
+// writes at most one line per interval. As each line holds the totals, the
+// drops of suppressed lines are included in the next one. If a notifier is
+// configured, the counts of each interval are sent to it with the first drop
+// after the interval passed. It is shared by all clients created for the
+// same output.
+type dropSummary struct {
+	mu       sync.Mutex
+	log      *logp.Logger
+	interval time.Duration
+	notifier *dropNotifier
+	totals   map[string]int
+
+	// counts and sample are the drops since the last notification
+	since  time.Time
+	counts map[string]int
+	sample eventRaw
+}
+
+func newDropSummary(interval time.Duration, notifier *dropNotifier) *dropSummary {
+	return &dropSummary{
+		log:      logger.Throttled(interval),
+		interval: interval,
+		notifier: notifier,
+		totals:   map[string]int{},
+		since:    time.Now(),
+		counts:   map[string]int{},
+	}
+}
+
+// keepSample remembers event as example of the dropped events, if no
+// example was kept since the last notification.
+func (d *dropSummary) keepSample(event *beat.Event) {
+	if d == nil || d.notifier == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.sample == nil {
+		d.sample = makeEvent(event)
+	}
+}
+
+// record adds n events dropped for reason. A nil summary ignores drops.
+func (d *dropSummary) record(reason string, n int) {
+	if d == nil || n <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.totals[reason] += n
+	d.log.Warnf("Dropped events since startup: %s", formatCounts(d.totals))
+	if d.notifier == nil {
+		return
+	}
+	d.counts[reason] += n
+	if time.Since(d.since) >= d.interval {
+		d.notifyLocked()
+	}
+}
+
+// notifyLocked sends the counts since the last notification.
+func (d *dropSummary) notifyLocked() {
+	elapsed := time.Since(d.since)
+	total := 0
+	for _, n := range d.counts {
+		total += n
+	}
+	d.notifier.notify(dropNotification{
+		Dropped:  d.counts,
+		Total:    total,
+		Interval: elapsed.Round(time.Second).String(),
+		Sample:   d.sample,
+	})
+	d.counts = map[string]int{}
+	d.sample = nil
+	d.since = time.Now()
+}
+
+// formatCounts formats counts as "reason=n" pairs, sorted by reason.
+func formatCounts(counts map[string]int) string {
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%s=%d", reason, counts[reason])
+	}
+	return strings.Join(reasons, " ")
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDropSummaryTotals(t *testing.T) {
+	d := newDropSummary(time.Hour, nil)
+	d.record("encode", 2)
+	d.record("expired", 40)
+	d.record("encode", 10)
+	d.record("rejected", 0)
+
+	if got, want := formatCounts(d.totals), "encode=12 expired=40"; got != want {
+		t.Errorf("totals = %q, want %q", got, want)
+	}
+	if len(d.counts) != 0 {
+		t.Errorf("counted %v for notifications without a notifier", d.counts)
+	}
+}
+
+func TestDropSummaryNotifiesPerInterval(t *testing.T) {
+	notes := make(chan dropNotification, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var note dropNotification
+		if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+			t.Errorf("decoding notification: %v", err)
+		}
+		notes <- note
+	}))
+	defer server.Close()
+
+	d := newDropSummary(20*time.Millisecond, newDropNotifier(server.URL, time.Second, nil))
+	d.record("expired", 3)
+	time.Sleep(30 * time.Millisecond)
+	d.record("rejected", 1)
+
+	select {
+	case note := <-notes:
+		if note.Total != 4 || note.Dropped["expired"] != 3 || note.Dropped["rejected"] != 1 {
+			t.Errorf("notified %+v, want expired=3 rejected=1", note)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification sent")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.counts) != 0 || d.totals["expired"] != 3 {
+		t.Errorf("counts %v and totals %v after the notification", d.counts, d.totals)
+	}
+}
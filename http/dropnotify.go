@@ -0,0 +1,66 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+)
+
+// dropNotifier posts drop summaries to drop_notify_url. Notifications are
+// best effort: they are sent in the background, one at a time, and a
+// summary is discarded while the previous notification is still in flight.
+type dropNotifier struct {
+	url  string
+	http *http.Client
+	busy int32
+}
+
+type dropNotification struct {
+	Dropped  map[string]int `json:"dropped"`
+	Total    int            `json:"total"`
+	Interval string         `json:"interval"`
+	Sample   eventRaw       `json:"sample,omitempty"`
+}
+
+func newDropNotifier(url string, timeout time.Duration, guard *addressGuard) *dropNotifier {
+	t := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if guard != nil {
+		t.Proxy = nil
+		t.Dial = guardedDialer(transport.NetDialer(timeout), guard).Dial
+	}
+	return &dropNotifier{
+		url: url,
+		http: &http.Client{
+			Transport: t,
+			Timeout:   timeout,
+		},
+	}
+}
+
+func (n *dropNotifier) notify(note dropNotification) {
+	if !atomic.CompareAndSwapInt32(&n.busy, 0, 1) {
+		logger.Debugf("Skipping drop notification, previous one still in progress.")
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&n.busy, 0)
+		body, err := json.Marshal(note)
+		if err != nil {
+			logger.Warnf("Failed to encode drop notification: %v", err)
+			return
+		}
+		resp, err := n.http.Post(n.url, "application/json; charset=UTF-8", bytes.NewReader(body))
+		if err != nil {
+			logger.Warnf("Failed to send drop notification to %s: %v", n.url, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Warnf("Drop notification to %s failed with status %d", n.url, resp.StatusCode)
+		}
+	}()
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"reflect"
@@ -13,6 +14,18 @@ type bodyEncoder interface {
 	bulkBodyEncoder
 	Reader() io.Reader
 	Marshal(doc interface{}) error
+	// MarshalRaw sets the body to the given bytes without JSON encoding.
+	MarshalRaw(body []byte) error
+	// Sizes returns the number of bytes written to the encoder and the
+	// number of bytes in the encoded body. Only valid after Reader.
+	Sizes() (raw, encoded int)
+}
+
+// streamEncoder is a bodyEncoder that can compress a batch into w while it is
+// sent, flushing after every event.
+type streamEncoder interface {
+	bodyEncoder
+	Stream(w io.Writer, events []eventRaw) error
 }
 
 type bulkBodyEncoder interface {
@@ -27,29 +40,166 @@ type bulkWriter interface {
 	AddRaw(raw interface{}) error
 }
 
+// batchFraming describes how the events of a batch are joined into a body.
+// If CountField is set, Prefix opens a JSON object and the number of events
+// is inserted as its first member. If Indent is set, events are
+// pretty-printed with it, in batches and single event bodies alike. If
+// GroupSize is set, up to GroupSize events are written as one JSON array
+// and Separator joins these arrays instead of the events.
+type batchFraming struct {
+	Prefix     string
+	Separator  string
+	Suffix     string
+	CountField string
+	Indent     string
+	GroupSize  int
+}
+
+var (
+	jsonFraming      = batchFraming{Prefix: "[", Separator: ",", Suffix: "]\n"}
+	jsonLinesFraming = batchFraming{Prefix: "", Separator: "\n", Suffix: "\n"}
+)
+
+// newBodyEncoder creates the encoder for the given format and gzip
+// compression level, where level 0 disables compression. With flush set the
+// compressed stream is flushed after every event of a batch.
+func newBodyEncoder(format string, compression int, framing batchFraming, flush bool) (bodyEncoder, error) {
+	if compression == 0 {
+		switch format {
+		case "json":
+			return newJSONEncoder(nil, framing), nil
+		case "json_lines", "ndjson_grouped":
+			return newJSONLinesEncoder(nil, framing), nil
+		}
+	} else {
+		switch format {
+		case "json":
+			return newGzipEncoder(compression, nil, framing, flush)
+		case "json_lines", "ndjson_grouped":
+			return newGzipLinesEncoder(compression, nil, framing, flush)
+		}
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+func defaultBatchFraming(format string) batchFraming {
+	if format == "json_lines" || format == "ndjson_grouped" {
+		return jsonLinesFraming
+	}
+	return jsonFraming
+}
+
 type jsonEncoder struct {
-	buf *bytes.Buffer
+	buf     *bytes.Buffer
+	framing batchFraming
 }
 
 type jsonLinesEncoder struct {
-	buf *bytes.Buffer
+	buf     *bytes.Buffer
+	framing batchFraming
 }
 
 type gzipEncoder struct {
-	buf  *bytes.Buffer
-	gzip *gzip.Writer
+	buf     *bytes.Buffer
+	gzip    *gzip.Writer
+	count   *countingWriter
+	framing batchFraming
 }
 
 type gzipLinesEncoder struct {
-	buf  *bytes.Buffer
-	gzip *gzip.Writer
+	buf     *bytes.Buffer
+	gzip    *gzip.Writer
+	count   *countingWriter
+	framing batchFraming
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w     io.Writer
+	n     int
+	flush func() error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// flushRecord is called by writeBatch after every event.
+func (c *countingWriter) flushRecord() error {
+	if c.flush == nil {
+		return nil
+	}
+	return c.flush()
+}
+
+// writeBatch writes events to w, joined according to framing.
+func writeBatch(w io.Writer, events []eventRaw, framing batchFraming) error {
+	prefix := framing.Prefix
+	if framing.CountField != "" {
+		field, err := json.Marshal(framing.CountField)
+		if err != nil {
+			return err
+		}
+		prefix = fmt.Sprintf("{%s:%d,%s", field, len(events), prefix[1:])
+	}
+	if _, err := io.WriteString(w, prefix); err != nil {
+		return err
+	}
+	group := framing.GroupSize
+	for i, event := range events {
+		if i > 0 {
+			separator := framing.Separator
+			if group > 0 && i%group != 0 {
+				separator = ","
+			}
+			if _, err := io.WriteString(w, separator); err != nil {
+				return err
+			}
+		}
+		if group > 0 && i%group == 0 {
+			if _, err := io.WriteString(w, "["); err != nil {
+				return err
+			}
+		}
+		b, err := marshalEvent(event, framing.Indent)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if group > 0 && (i%group == group-1 || i == len(events)-1) {
+			if _, err := io.WriteString(w, "]"); err != nil {
+				return err
+			}
+		}
+		if f, ok := w.(interface{ flushRecord() error }); ok {
+			if err := f.flushRecord(); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, framing.Suffix)
+	return err
 }
 
-func newJSONEncoder(buf *bytes.Buffer) *jsonEncoder {
+// marshalEvent encodes event on a single line, or pretty-printed if indent
+// is set. MarshalIndent breaks lines even with an empty indent, which would
+// break line based framings.
+func marshalEvent(event interface{}, indent string) ([]byte, error) {
+	if indent == "" {
+		return json.Marshal(event)
+	}
+	return json.MarshalIndent(event, "", indent)
+}
+
+func newJSONEncoder(buf *bytes.Buffer, framing batchFraming) *jsonEncoder {
 	if buf == nil {
 		buf = bytes.NewBuffer(nil)
 	}
-	return &jsonEncoder{buf}
+	return &jsonEncoder{buf, framing}
 }
 
 func (b *jsonEncoder) Reset() {
@@ -68,12 +218,28 @@ func (b *jsonEncoder) Reader() io.Reader {
 	return b.buf
 }
 
+func (b *jsonEncoder) Sizes() (int, int) {
+	return b.buf.Len(), b.buf.Len()
+}
+
 func (b *jsonEncoder) Marshal(obj interface{}) error {
 	b.Reset()
+	if events, ok := obj.([]eventRaw); ok {
+		return writeBatch(b.buf, events, b.framing)
+	}
 	enc := json.NewEncoder(b.buf)
+	if b.framing.Indent != "" {
+		enc.SetIndent("", b.framing.Indent)
+	}
 	return enc.Encode(obj)
 }
 
+func (b *jsonEncoder) MarshalRaw(body []byte) error {
+	b.Reset()
+	_, err := b.buf.Write(body)
+	return err
+}
+
 func (b *jsonEncoder) AddRaw(raw interface{}) error {
 	enc := json.NewEncoder(b.buf)
 	return enc.Encode(raw)
@@ -94,11 +260,11 @@ func (b *jsonEncoder) Add(meta, obj interface{}) error {
 	return nil
 }
 
-func newJSONLinesEncoder(buf *bytes.Buffer) *jsonLinesEncoder {
+func newJSONLinesEncoder(buf *bytes.Buffer, framing batchFraming) *jsonLinesEncoder {
 	if buf == nil {
 		buf = bytes.NewBuffer(nil)
 	}
-	return &jsonLinesEncoder{buf}
+	return &jsonLinesEncoder{buf, framing}
 }
 
 func (b *jsonLinesEncoder) Reset() {
@@ -117,11 +283,21 @@ func (b *jsonLinesEncoder) Reader() io.Reader {
 	return b.buf
 }
 
+func (b *jsonLinesEncoder) Sizes() (int, int) {
+	return b.buf.Len(), b.buf.Len()
+}
+
 func (b *jsonLinesEncoder) Marshal(obj interface{}) error {
 	b.Reset()
 	return b.AddRaw(obj)
 }
 
+func (b *jsonLinesEncoder) MarshalRaw(body []byte) error {
+	b.Reset()
+	_, err := b.buf.Write(body)
+	return err
+}
+
 func (b *jsonLinesEncoder) AddRaw(obj interface{}) error {
 	enc := json.NewEncoder(b.buf)
 
@@ -131,13 +307,7 @@ func (b *jsonLinesEncoder) AddRaw(obj interface{}) error {
 	}
 
 	// batch of events
-	for _, item := range obj.([]eventRaw) {
-		err := enc.Encode(item)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return writeBatch(b.buf, obj.([]eventRaw), b.framing)
 }
 
 func (b *jsonLinesEncoder) Add(meta, obj interface{}) error {
@@ -155,7 +325,7 @@ func (b *jsonLinesEncoder) Add(meta, obj interface{}) error {
 	return nil
 }
 
-func newGzipEncoder(level int, buf *bytes.Buffer) (*gzipEncoder, error) {
+func newGzipEncoder(level int, buf *bytes.Buffer, framing batchFraming, flush bool) (*gzipEncoder, error) {
 	if buf == nil {
 		buf = bytes.NewBuffer(nil)
 	}
@@ -164,12 +334,13 @@ func newGzipEncoder(level int, buf *bytes.Buffer) (*gzipEncoder, error) {
 		return nil, err
 	}
 
-	return &gzipEncoder{buf, w}, nil
+	return &gzipEncoder{buf, w, newGzipCounter(w, flush), framing}, nil
 }
 
 func (b *gzipEncoder) Reset() {
 	b.buf.Reset()
 	b.gzip.Reset(b.buf)
+	b.count.n = 0
 }
 
 func (b *gzipEncoder) Reader() io.Reader {
@@ -177,6 +348,10 @@ func (b *gzipEncoder) Reader() io.Reader {
 	return b.buf
 }
 
+func (b *gzipEncoder) Sizes() (int, int) {
+	return b.count.n, b.buf.Len()
+}
+
 func (b *gzipEncoder) AddHeader(header *http.Header, contentType string) {
 	if (contentType == "") {
 		header.Add("Content-Type", "application/json; charset=UTF-8")
@@ -188,18 +363,34 @@ func (b *gzipEncoder) AddHeader(header *http.Header, contentType string) {
 
 func (b *gzipEncoder) Marshal(obj interface{}) error {
 	b.Reset()
-	enc := json.NewEncoder(b.gzip)
+	if events, ok := obj.([]eventRaw); ok {
+		return writeBatch(b.count, events, b.framing)
+	}
+	enc := json.NewEncoder(b.count)
+	if b.framing.Indent != "" {
+		enc.SetIndent("", b.framing.Indent)
+	}
 	err := enc.Encode(obj)
 	return err
 }
 
+func (b *gzipEncoder) Stream(w io.Writer, events []eventRaw) error {
+	return streamGzip(b.gzip, b.count, w, events, b.framing)
+}
+
+func (b *gzipEncoder) MarshalRaw(body []byte) error {
+	b.Reset()
+	_, err := b.count.Write(body)
+	return err
+}
+
 func (b *gzipEncoder) AddRaw(raw interface{}) error {
-	enc := json.NewEncoder(b.gzip)
+	enc := json.NewEncoder(b.count)
 	return enc.Encode(raw)
 }
 
 func (b *gzipEncoder) Add(meta, obj interface{}) error {
-	enc := json.NewEncoder(b.gzip)
+	enc := json.NewEncoder(b.count)
 	pos := b.buf.Len()
 
 	if err := enc.Encode(meta); err != nil {
@@ -215,7 +406,7 @@ func (b *gzipEncoder) Add(meta, obj interface{}) error {
 	return nil
 }
 
-func newGzipLinesEncoder(level int, buf *bytes.Buffer) (*gzipLinesEncoder, error) {
+func newGzipLinesEncoder(level int, buf *bytes.Buffer, framing batchFraming, flush bool) (*gzipLinesEncoder, error) {
 	if buf == nil {
 		buf = bytes.NewBuffer(nil)
 	}
@@ -224,12 +415,13 @@ func newGzipLinesEncoder(level int, buf *bytes.Buffer) (*gzipLinesEncoder, error
 		return nil, err
 	}
 
-	return &gzipLinesEncoder{buf, w}, nil
+	return &gzipLinesEncoder{buf, w, newGzipCounter(w, flush), framing}, nil
 }
 
 func (b *gzipLinesEncoder) Reset() {
 	b.buf.Reset()
 	b.gzip.Reset(b.buf)
+	b.count.n = 0
 }
 
 func (b *gzipLinesEncoder) Reader() io.Reader {
@@ -237,6 +429,10 @@ func (b *gzipLinesEncoder) Reader() io.Reader {
 	return b.buf
 }
 
+func (b *gzipLinesEncoder) Sizes() (int, int) {
+	return b.count.n, b.buf.Len()
+}
+
 func (b *gzipLinesEncoder) AddHeader(header *http.Header, contentType string) {
 	if (contentType == "") {
 		header.Add("Content-Type", "application/x-ndjson; charset=UTF-8")
@@ -251,8 +447,18 @@ func (b *gzipLinesEncoder) Marshal(obj interface{}) error {
 	return b.AddRaw(obj)
 }
 
+func (b *gzipLinesEncoder) Stream(w io.Writer, events []eventRaw) error {
+	return streamGzip(b.gzip, b.count, w, events, b.framing)
+}
+
+func (b *gzipLinesEncoder) MarshalRaw(body []byte) error {
+	b.Reset()
+	_, err := b.count.Write(body)
+	return err
+}
+
 func (b *gzipLinesEncoder) AddRaw(obj interface{}) error {
-	enc := json.NewEncoder(b.gzip)
+	enc := json.NewEncoder(b.count)
 
 	// single event
 	if reflect.TypeOf(obj).Kind() == reflect.Map {
@@ -260,13 +466,7 @@ func (b *gzipLinesEncoder) AddRaw(obj interface{}) error {
 	}
 
 	// batch of events
-	for _, item := range obj.([]eventRaw) {
-		err := enc.Encode(item)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return writeBatch(b.count, obj.([]eventRaw), b.framing)
 }
 
 func (b *gzipLinesEncoder) Add(meta, obj interface{}) error {
@@ -284,3 +484,24 @@ func (b *gzipLinesEncoder) Add(meta, obj interface{}) error {
 	b.gzip.Flush()
 	return nil
 }
+
+// streamGzip compresses events into w instead of the buffer of the encoder,
+// the next Reset writes to the buffer again.
+func streamGzip(gz *gzip.Writer, count *countingWriter, w io.Writer, events []eventRaw, framing batchFraming) error {
+	gz.Reset(w)
+	count.n = 0
+	if err := writeBatch(count, events, framing); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// newGzipCounter counts the bytes written to w, flushing w after every
+// event of a batch if flush is set.
+func newGzipCounter(w *gzip.Writer, flush bool) *countingWriter {
+	c := &countingWriter{w: w}
+	if flush {
+		c.flush = w.Flush
+	}
+	return c
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func testRawEvents() []eventRaw {
+	return []eventRaw{
+		{"message": json.RawMessage(`"a"`), "n": json.RawMessage(`{"x":1}`)},
+		{"message": json.RawMessage(`"b"`)},
+	}
+}
+
+func encodeBody(t *testing.T, enc bodyEncoder, obj interface{}) string {
+	t.Helper()
+	if err := enc.Marshal(obj); err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(enc.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, compressed := enc.(*gzipLinesEncoder); !compressed {
+		return string(body)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestJSONLinesCompact(t *testing.T) {
+	want := "{\"message\":\"a\",\"n\":{\"x\":1}}\n{\"message\":\"b\"}\n"
+	for _, compression := range []int{0, 5} {
+		enc, err := newBodyEncoder("json_lines", compression, jsonLinesFraming, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := encodeBody(t, enc, testRawEvents()); got != want {
+			t.Errorf("compression %d: got %q, want %q", compression, got, want)
+		}
+	}
+}
+
+func TestJSONPretty(t *testing.T) {
+	framing := jsonFraming
+	framing.Indent = "  "
+	enc, err := newBodyEncoder("json", 0, framing, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{\n  \"message\": \"b\"\n}]\n"
+	if got := encodeBody(t, enc, testRawEvents()[1:]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	enc, err = newBodyEncoder("json", 0, jsonFraming, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encodeBody(t, enc, testRawEvents()[1]); got != "{\"message\":\"b\"}\n" {
+		t.Errorf("single event body %q is not compact", got)
+	}
+}
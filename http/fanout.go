@@ -0,0 +1,137 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+// fanoutClient sends every batch to all hosts in parallel. The batch is
+// acknowledged once enough hosts accepted it, as configured by
+// fanout_require, and retried on all hosts otherwise. There is one client
+// per host, hosts listed once per worker are only sent to once. The outcome
+// of a batch is reported to the observer, and events are dead-lettered, only
+// once, by report. It is not connected, the clients of the hosts don't report.
+type fanoutClient struct {
+	clients  []*Client
+	required int
+	report   *Client
+}
+
+func newFanoutClient(clients []*Client, require string, report *Client) *fanoutClient {
+	required := len(clients)
+	switch require {
+	case "any":
+		required = 1
+	case "quorum":
+		required = len(clients)/2 + 1
+	}
+	return &fanoutClient{clients: clients, required: required, report: report}
+}
+
+func (f *fanoutClient) Connect() error {
+	var errs []string
+	for _, client := range f.clients {
+		if err := client.Connect(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", client, err))
+		}
+	}
+	if len(f.clients)-len(errs) < f.required {
+		return fmt.Errorf("too few hosts connected: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f *fanoutClient) Close() error {
+	var err error
+	for _, client := range f.clients {
+		if cerr := client.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (f *fanoutClient) String() string {
+	hosts := make([]string, len(f.clients))
+	for i, client := range f.clients {
+		hosts[i] = client.String()
+	}
+	return "fanout(" + strings.Join(hosts, ",") + ")"
+}
+
+// Publish sends the batch to all hosts. Hosts that lost their connection are
+// reconnected first, so a host that failed earlier rejoins the fanout. The
+// batch is settled like by a single client, so failed batches count against
+// max_retries and drop_on_all_hosts_down.
+func (f *fanoutClient) Publish(_ context.Context, batch publisher.Batch) error {
+	events := batch.Events()
+	errs := make([]error, len(f.clients))
+	var wg sync.WaitGroup
+	for i, client := range f.clients {
+		wg.Add(1)
+		go func(i int, client *Client, events []publisher.Event) {
+			defer wg.Done()
+			if !client.isConnected() {
+				if err := client.Connect(); err != nil {
+					client.markHealth(false)
+					errs[i] = err
+					return
+				}
+			}
+			rest, err := client.publishEvents(events)
+			if len(rest) > 0 && err == nil {
+				err = fmt.Errorf("%d events not published", len(rest))
+			}
+			client.markHealth(err == nil)
+			errs[i] = err
+		}(i, client, copyEvents(events))
+	}
+	wg.Wait()
+
+	succeeded := 0
+	var failures []string
+	for i, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", f.clients[i], err))
+	}
+	if succeeded >= f.required {
+		if len(failures) > 0 {
+			logger.Warnf("Fanout batch accepted by %d of %d hosts, failed on: %s",
+				succeeded, len(f.clients), strings.Join(failures, "; "))
+		}
+		f.report.acked(len(events))
+		return f.report.settle(batch, events, nil, nil)
+	}
+	// hosts that accepted the batch receive it again on retry
+	err := fmt.Errorf("fanout batch accepted by %d of %d hosts, %d required: %s",
+		succeeded, len(f.clients), f.required, strings.Join(failures, "; "))
+	return f.report.settle(batch, events, events, err)
+}
+
+// copyEvents returns copies of events that a single host can transform
+// without affecting the other hosts. The copies keep the retry bookkeeping
+// of the events.
+func copyEvents(events []publisher.Event) []publisher.Event {
+	copies := make([]publisher.Event, len(events))
+	for i := range events {
+		event := &events[i]
+		copies[i] = publisher.Event{Content: event.Content, Flags: event.Flags}
+		copies[i].Content.Fields = event.Content.Fields.Clone()
+		if event.Content.Meta != nil {
+			copies[i].Content.Meta = event.Content.Meta.Clone()
+		}
+		for _, key := range []string{retriesKey, firstRetryKey, triedHostsKey} {
+			if value, err := event.Cache.GetValue(key); err == nil {
+				copies[i].Cache.Put(key, value)
+			}
+		}
+	}
+	return copies
+}
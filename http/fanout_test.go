@@ -0,0 +1,139 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestFanout(t *testing.T, s ClientSettings, require string, failing ...bool) (*fanoutClient, []*fakeDoer) {
+	t.Helper()
+	report := newTestClient(t, s, &fakeDoer{})
+	s.fanoutHost = true
+	var clients []*Client
+	var doers []*fakeDoer
+	for i, fail := range failing {
+		doer := &fakeDoer{}
+		if fail {
+			doer.respond = func(*http.Request) (*http.Response, error) {
+				return response(http.StatusServiceUnavailable, ""), nil
+			}
+		}
+		s.URL = fmt.Sprintf("http://host%d:8080/ingest", i)
+		clients = append(clients, newTestClient(t, s, doer))
+		doers = append(doers, doer)
+	}
+	return newFanoutClient(clients, require, report), doers
+}
+
+func TestFanoutRequire(t *testing.T) {
+	tests := []struct {
+		require string
+		failing []bool
+		acked   bool
+	}{
+		{"all", []bool{false, false, false}, true},
+		{"all", []bool{false, false, true}, false},
+		{"quorum", []bool{false, false, true}, true},
+		{"quorum", []bool{false, true, true}, false},
+		{"any", []bool{false, true, true}, true},
+		{"any", []bool{true, true, true}, false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %v", test.require, test.failing), func(t *testing.T) {
+			fanout, doers := newTestFanout(t, ClientSettings{BatchPublish: true}, test.require, test.failing...)
+			batch := &fakeBatch{events: testEvents(3)}
+			err := fanout.Publish(context.Background(), batch)
+			if batch.acked != test.acked {
+				t.Errorf("acked = %v, want %v (err %v)", batch.acked, test.acked, err)
+			}
+			if !test.acked && len(batch.retried) != 3 {
+				t.Errorf("retried %d events, want 3", len(batch.retried))
+			}
+			for i, doer := range doers {
+				if doer.count() != 1 {
+					t.Errorf("host %d received %d requests, want 1", i, doer.count())
+				}
+			}
+		})
+	}
+}
+
+func TestFanoutMaxRetries(t *testing.T) {
+	s := ClientSettings{BatchPublish: true, MaxRetries: 1, DropAfterMax: true}
+	fanout, _ := newTestFanout(t, s, "all", false, true)
+	events := testEvents(2)
+
+	batch := &fakeBatch{events: events}
+	fanout.Publish(context.Background(), batch)
+	if len(batch.retried) != 2 {
+		t.Fatalf("first attempt retried %d events, want 2", len(batch.retried))
+	}
+	batch = &fakeBatch{events: batch.retried}
+	fanout.Publish(context.Background(), batch)
+	if !batch.dropped || len(batch.retried) != 0 {
+		t.Errorf("events over max_retries were not dropped: dropped %v, retried %d", batch.dropped, len(batch.retried))
+	}
+}
+
+func TestFanoutReportsOnce(t *testing.T) {
+	tests := []struct {
+		require                string
+		failing                []bool
+		acked, failed, retried int
+	}{
+		{"all", []bool{false, false, false}, 3, 0, 0},
+		{"any", []bool{false, true, true}, 3, 0, 0},
+		{"all", []bool{false, false, true}, 0, 3, 3},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %v", test.require, test.failing), func(t *testing.T) {
+			observer := &fakeObserver{}
+			s := ClientSettings{BatchPublish: true, Observer: observer}
+			fanout, _ := newTestFanout(t, s, test.require, test.failing...)
+			batch := &fakeBatch{events: testEvents(3)}
+			fanout.Publish(context.Background(), batch)
+			if observer.acked != test.acked || observer.failed != test.failed || observer.dropped != 0 {
+				t.Errorf("observer counted acked %d, failed %d, dropped %d, want acked %d, failed %d",
+					observer.acked, observer.failed, observer.dropped, test.acked, test.failed)
+			}
+			if len(batch.retried) != test.retried {
+				t.Errorf("retried %d events, want %d", len(batch.retried), test.retried)
+			}
+		})
+	}
+}
+
+func TestFanoutDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letter.ndjson")
+	observer := &fakeObserver{}
+	s := ClientSettings{BatchPublish: true, Observer: observer, OnFailure: "dead_letter", DeadLetterPath: path, MaxRetries: 0, DropAfterMax: true}
+	fanout, doers := newTestFanout(t, s, "all", false, false, false)
+	// two hosts reject the events, which fails them rather than
+	// dead-lettering the events per host
+	for _, doer := range doers[1:] {
+		doer.respond = func(*http.Request) (*http.Response, error) {
+			return response(http.StatusBadRequest, ""), nil
+		}
+	}
+
+	batch := &fakeBatch{events: testEvents(2)}
+	fanout.Publish(context.Background(), batch)
+	if !batch.dropped {
+		t.Errorf("batch not dropped after max_retries, retried %d", len(batch.retried))
+	}
+	lines, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(lines), "\n"); n != 2 {
+		t.Errorf("%d events dead-lettered, want 2", n)
+	}
+	if observer.dropped != 2 || observer.acked != 0 {
+		t.Errorf("observer counted dropped %d and acked %d, want 2 dropped", observer.dropped, observer.acked)
+	}
+}
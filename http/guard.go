@@ -0,0 +1,110 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+)
+
+// addressGuard decides which addresses connections may be made to. It is
+// enforced when dialing, so redirects and dynamic URLs can't bypass it.
+// Transports dialing through it must not use a proxy, as the proxy would be
+// the only peer it sees.
+type addressGuard struct {
+	// names are lower case host names, "*.example.com" matches all
+	// subdomains of example.com
+	names   []string
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// newAddressGuard parses allowedHosts, host names, IP addresses or CIDRs,
+// and deniedCIDRs. An empty allowedHosts allows all addresses that are not
+// denied.
+func newAddressGuard(allowedHosts, deniedCIDRs []string) (*addressGuard, error) {
+	g := &addressGuard{}
+	for _, host := range allowedHosts {
+		if network, err := parseNetwork(host); err == nil {
+			g.allowed = append(g.allowed, network)
+		} else {
+			g.names = append(g.names, strings.ToLower(host))
+		}
+	}
+	for _, cidr := range deniedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR in denied_cidrs: %s", cidr)
+		}
+		g.denied = append(g.denied, network)
+	}
+	return g, nil
+}
+
+// parseNetwork parses a CIDR or a single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// check returns an error unless a connection to ip, dialed as host, is
+// allowed.
+func (g *addressGuard) check(host string, ip net.IP) error {
+	for _, network := range g.denied {
+		if network.Contains(ip) {
+			return fmt.Errorf("connection to %s (%s) denied by denied_cidrs", host, ip)
+		}
+	}
+	if len(g.names) == 0 && len(g.allowed) == 0 {
+		return nil
+	}
+	for _, network := range g.allowed {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	host = strings.ToLower(host)
+	for _, name := range g.names {
+		if host == name || strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("connection to %s (%s) not in allowed_hosts", host, ip)
+}
+
+// guardedDialer checks the peer of each connection d made against g and
+// closes it, before anything was sent, if it is not allowed. Checking the
+// peer rather than the resolved name covers DNS changes between lookup and
+// connect as well as resolve overrides.
+func guardedDialer(d transport.Dialer, g *addressGuard) transport.Dialer {
+	return transport.DialerFunc(func(network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := d.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP
+		} else if ip = net.ParseIP(host); ip == nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot determine the address of %s", address)
+		}
+		if err := g.check(host, ip); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+}
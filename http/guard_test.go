@@ -0,0 +1,87 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuardDeniedCIDRs(t *testing.T) {
+	for name, test := range map[string]struct {
+		allowed, denied []string
+		sent            bool
+	}{
+		"denied":            {denied: []string{"127.0.0.0/8"}},
+		"not allowed":       {allowed: []string{"10.0.0.0/8"}},
+		"allowed by IP":     {allowed: []string{"127.0.0.1"}, sent: true},
+		"other CIDR denied": {allowed: []string{"127.0.0.1"}, denied: []string{"10.0.0.0/8"}, sent: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			guard, err := newAddressGuard(test.allowed, test.denied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+			}))
+			defer server.Close()
+
+			client, err := NewClient(ClientSettings{URL: server.URL + "/ingest", Format: "json", BatchPublish: true, Timeout: time.Second, guard: guard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Connect()
+			defer client.Close()
+			batch := &fakeBatch{events: testEvents(1)}
+			client.Publish(context.Background(), batch)
+			if sent := requests > 0; sent != test.sent {
+				t.Errorf("sent = %v, want %v", sent, test.sent)
+			}
+			if batch.acked != test.sent {
+				t.Errorf("acked = %v, want %v", batch.acked, test.sent)
+			}
+		})
+	}
+}
+
+// TestGuardTransports checks that requests besides publishing, to
+// drop_notify_url and oauth2.token_url, are guarded too.
+func TestGuardTransports(t *testing.T) {
+	guard, err := newAddressGuard(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	notifier := newDropNotifier(server.URL, time.Second, guard)
+	if _, err := notifier.http.Post(server.URL, "application/json", strings.NewReader("{}")); err == nil || !strings.Contains(err.Error(), "denied_cidrs") {
+		t.Errorf("drop notification error = %v, want denied", err)
+	}
+	source, err := newOAuth2Source(oauth2Config{TokenURL: server.URL}, time.Second, guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.fetch(); err == nil || !strings.Contains(err.Error(), "denied_cidrs") {
+		t.Errorf("token request error = %v, want denied", err)
+	}
+	if requests != 0 {
+		t.Errorf("server received %d requests, want none", requests)
+	}
+}
+
+func TestGuardRejectsProxy(t *testing.T) {
+	c := defaultConfig
+	c.ProxyURL = "http://proxy.example.com:3128"
+	c.DeniedCIDRs = []string{"127.0.0.0/8"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "proxy_url cannot be used with allowed_hosts or denied_cidrs") {
+		t.Errorf("Validate() = %v, want proxy_url rejected", err)
+	}
+}
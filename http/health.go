@@ -0,0 +1,56 @@
+package http
+
+import (
+	"sync"
+	"time"
+)
+
+// hostHealth tracks which hosts of an output are currently failing. It is
+// shared by all clients created for the same output.
+type hostHealth struct {
+	mu           sync.Mutex
+	hosts        int
+	down         map[string]bool
+	allDownSince time.Time
+}
+
+// newHostHealth tracks hosts, which may list a host once per worker.
+func newHostHealth(hosts []string) *hostHealth {
+	n := len(uniqueHosts(hosts))
+	return &hostHealth{
+		hosts: n,
+		down:  make(map[string]bool, n),
+	}
+}
+
+// markDown records a failed publish attempt against host.
+func (h *hostHealth) markDown(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.down[host] = true
+	if len(h.down) >= h.hosts && h.allDownSince.IsZero() {
+		h.allDownSince = time.Now()
+	}
+}
+
+// markUp records a successful publish against host.
+func (h *hostHealth) markUp(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.down, host)
+	h.allDownSince = time.Time{}
+}
+
+// allDownFor returns for how long all hosts have been failing, or 0 if at
+// least one host is healthy.
+func (h *hostHealth) allDownFor() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.allDownSince.IsZero() {
+		return 0
+	}
+	return time.Since(h.allDownSince)
+}
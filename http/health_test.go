@@ -0,0 +1,37 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDropOnAllHostsDown(t *testing.T) {
+	// two workers for host a, one for host b
+	health := newHostHealth([]string{"a:8080", "a:8080", "b:8080"})
+	failing := func(*http.Request) (*http.Response, error) {
+		return response(http.StatusServiceUnavailable, ""), nil
+	}
+	newClient := func(url string) *Client {
+		s := ClientSettings{URL: url, BatchPublish: true, MaxPending: time.Nanosecond, health: health}
+		return newTestClient(t, s, &fakeDoer{respond: failing})
+	}
+	a1, a2, b := newClient("http://a:8080/"), newClient("http://a:8080/"), newClient("http://b:8080/")
+
+	for _, client := range []*Client{a1, a2} {
+		batch := &fakeBatch{events: testEvents(2)}
+		client.Publish(context.Background(), batch)
+		if batch.dropped || len(batch.retried) != 2 {
+			t.Fatalf("events dropped while host b is up: dropped %v, retried %d", batch.dropped, len(batch.retried))
+		}
+	}
+
+	b.Publish(context.Background(), &fakeBatch{events: testEvents(2)})
+	time.Sleep(time.Millisecond)
+	batch := &fakeBatch{events: testEvents(2)}
+	b.Publish(context.Background(), batch)
+	if !batch.dropped || len(batch.retried) != 0 {
+		t.Errorf("events not dropped with all hosts down: dropped %v, retried %d", batch.dropped, len(batch.retried))
+	}
+}
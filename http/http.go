@@ -2,6 +2,8 @@ package http
 
 import (
 	"errors"
+	"fmt"
+	"math"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
@@ -9,18 +11,45 @@ import (
 	conf "github.com/elastic/elastic-agent-libs/config"
 	"github.com/elastic/elastic-agent-libs/logp"
 	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 func init() {
 	outputs.RegisterType("http", MakeHTTP)
 }
 
+const selector = "output.http"
+
 var (
-	logger = logp.NewLogger("output.http")
+	logger = logp.NewLogger(selector)
 	// ErrNotConnected indicates failure due to client having no valid connection
 	ErrNotConnected = errors.New("not connected")
 	// ErrJSONEncodeFailed indicates encoding failures
 	ErrJSONEncodeFailed = errors.New("json encode failed")
+	// ErrTrailerStatus indicates a failure signaled through a response trailer
+	ErrTrailerStatus = errors.New("response trailer signaled failure")
+	// ErrStreamStatus indicates a failure signaled by the final line of a
+	// streamed response
+	ErrStreamStatus = errors.New("response stream signaled failure")
+	// ErrShutdownTimeout indicates held events could not be sent before
+	// shutdown_timeout passed
+	ErrShutdownTimeout = errors.New("shutdown timeout exceeded")
+	// ErrRetryBudget indicates events were retried for longer than
+	// retry_budget
+	ErrRetryBudget = errors.New("retry budget exceeded")
+	// ErrMaxHosts indicates events failed on max_hosts_per_publish hosts
+	ErrMaxHosts = errors.New("failed on too many hosts")
+	// ErrMaxRetries indicates events failed max_retries+1 times with
+	// drop_after_max_retries
+	ErrMaxRetries = errors.New("max retries exceeded")
+	// ErrBearerToken indicates the JWT or OAuth2 access token of a request
+	// could not be obtained, the request is retried
+	ErrBearerToken = errors.New("failed to get bearer token")
+	// ErrRejectedCount indicates the response reported rejected events of
+	// a batch by response.rejected_field or response.accepted_field
+	ErrRejectedCount = errors.New("server rejected events of the batch")
 )
 
 func MakeHTTP(
@@ -41,6 +70,17 @@ func MakeHTTP(
 	if err != nil {
 		return outputs.Fail(err)
 	}
+	concurrency := config.Concurrency
+	if config.Ordered {
+		// hosts are listed once per worker and workers publish concurrently,
+		// so events are only delivered in order by a single serial client
+		hosts = uniqueHosts(hosts)
+		concurrency = 1
+	}
+	if config.Fanout {
+		// every host receives each batch once, from a single client
+		hosts = uniqueHosts(hosts)
+	}
 	proxyURL, err := parseProxyURL(config.ProxyURL)
 	if err != nil {
 		return outputs.Fail(err)
@@ -52,37 +92,288 @@ func MakeHTTP(
 	if len(params) == 0 {
 		params = nil
 	}
+	var resolve map[string]string
+	if len(config.Resolve) > 0 {
+		resolve = make(map[string]string, len(config.Resolve))
+		for _, override := range config.Resolve {
+			resolve[override.Host] = override.Address
+		}
+	}
+	var guard *addressGuard
+	if len(config.AllowedHosts) > 0 || len(config.DeniedCIDRs) > 0 {
+		if guard, err = newAddressGuard(config.AllowedHosts, config.DeniedCIDRs); err != nil {
+			return outputs.Fail(err)
+		}
+	}
+	var svids x509svid.Source
+	if config.SPIFFE.Socket != "" {
+		// the source is shared by all clients and lives as long as the output
+		source, err := newSVIDSource(config.SPIFFE)
+		if err != nil {
+			return outputs.Fail(fmt.Errorf("failed to fetch SVID from %s: %v", config.SPIFFE.Socket, err))
+		}
+		svids = source
+	}
+	var protoMessage protoreflect.MessageDescriptor
+	if config.Format == "protobuf" {
+		protoMessage, err = loadProtoMessage(config.ProtoDescriptor, config.ProtoMessage)
+		if err != nil {
+			return outputs.Fail(err)
+		}
+	}
+	var limiter *rate.Limiter
+	if config.GlobalRateLimit > 0 {
+		// the limiter is safe for concurrent use by all clients
+		burst := int(math.Ceil(config.GlobalRateLimit))
+		limiter = rate.NewLimiter(rate.Limit(config.GlobalRateLimit), burst)
+	}
+	var notifier *dropNotifier
+	if config.DropNotifyURL != "" {
+		notifier = newDropNotifier(config.DropNotifyURL, config.Timeout, guard)
+	}
+	drops := newDropSummary(config.DropLogInterval, notifier)
+	var jwt *jwtSigner
+	if config.JWT.PrivateKey != "" {
+		if jwt, err = newJWTSigner(config.JWT); err != nil {
+			return outputs.Fail(err)
+		}
+	}
+	var oauth2 *oauth2Source
+	if config.OAuth2.TokenURL != "" {
+		if oauth2, err = newOAuth2Source(config.OAuth2, config.Timeout, guard); err != nil {
+			return outputs.Fail(err)
+		}
+	}
+	var credentials *fileCredentials
+	if config.UsernameFile != "" || config.PasswordFile != "" {
+		credentials, err = newFileCredentials(config.UsernameFile, config.PasswordFile, config.CredentialReload)
+		if err != nil {
+			return outputs.Fail(err)
+		}
+	}
+	var script *transformScript
+	if config.TransformScript != "" {
+		if script, err = newTransformScript(config.TransformScript); err != nil {
+			return outputs.Fail(err)
+		}
+	}
+	var pressure *backpressure
+	if config.Backpressure.QueueDepth > 0 || config.Backpressure.Latency > 0 {
+		pressure = newBackpressure(config.Backpressure)
+	}
+	var health *hostHealth
+	if config.DropOnHostsDown {
+		health = newHostHealth(hosts)
+	}
+	addFields := config.AddFields
+	if config.AddBeatMetadata {
+		addFields = withBeatMetadata(addFields, beat)
+	}
+	var streamMarker string
+	if config.Response.Stream {
+		streamMarker = config.Response.TerminalMarker
+	}
+	framing := config.batchFraming()
+	base := ClientSettings{
+		Proxy:            proxyURL,
+		TLS:              tlsConfig,
+		TLSSource:        config.TLS,
+		TLSReload:        config.TLSReload,
+		SVIDSource:       svids,
+		ServerName:       config.TLSServerName,
+		CertFingerprints: config.CertFingerprints,
+		SessionTickets:   config.SessionTickets,
+		HandshakeTimeout: config.TLSHandshake,
+		Username:         config.Username,
+		Password:         config.Password,
+		Parameters:       params,
+		ContextTimeout:   config.TimeoutMode == "context",
+		CompressionLevel: config.CompressionLevel,
+		NoCompressTypes:  config.NoCompressTypes,
+		CompressionFlush: config.CompressionFlush,
+		Observer:         observer,
+		BatchPublish:     config.BatchPublish,
+		Headers:          config.Headers,
+		ContentType:      config.ContentType,
+		Format:           config.Format,
+		ProtoMessage:     protoMessage,
+		BatchPrefix:      framing.Prefix,
+		BatchSeparator:   framing.Separator,
+		BatchSuffix:      framing.Suffix,
+		BatchCountField:  framing.CountField,
+		GroupSize:        config.groupSize(),
+		SigningCommand:   config.SigningCommand,
+		SigningArgs:      config.SigningArgs,
+		SigningHeader:    config.SigningHeader,
+		SigningTTL:       config.SigningTTL,
+		SigningTimeout:   config.SigningTimeout,
+		DedupField:       config.DedupField,
+		CoalesceFields:   config.CoalesceFields,
+		CoalesceSum:      config.CoalesceSum,
+		DedupCheckURL:    config.DedupCheckURL,
+		MaxEventAge:      config.MaxEventAge,
+		RetryBudget:      config.RetryBudget,
+		MaxHosts:         config.MaxHosts,
+		MaxRetries:       config.MaxRetries,
+		DropAfterMax:     config.DropAfterMax,
+		BatchSizeHeader:  config.BatchSizeHeader,
+		BatchIDHeader:    config.BatchIDHeader,
+		RequestIDField:   config.RequestIDField,
+		RequestIDHeader:  config.RequestIDHeader,
+		RequestIDGen:     config.RequestIDGen,
+		AddFields:        addFields,
+		RenameFields:     config.RenameFields,
+		CoerceFields:     config.CoerceFields,
+		CoerceDrop:       config.CoerceFailure == "drop",
+		ScriptDrop:       config.ScriptFailure == "drop",
+		DecimalNumbers:   config.NumberFormat == "decimal",
+		MaskFields:       config.MaskFields,
+		MaskMode:         config.MaskMode,
+		Flatten:          config.Flatten,
+		FlattenSep:       config.FlattenSep,
+		IndexArrays:      config.FlattenArrays == "index",
+		KeepaliveEvery:   config.Keepalive.Interval,
+		KeepaliveMethod:  config.Keepalive.Method,
+		KeepalivePath:    config.Keepalive.Path,
+		HealthEvery:      config.HealthCheck.Interval,
+		HealthMethod:     config.HealthCheck.Method,
+		HealthPath:       config.HealthCheck.Path,
+		HealthEmptyBody:  config.HealthCheck.EmptyBody,
+		OnFailure:        config.OnFailure,
+		RetryOnStatus:    config.RetryOnStatus,
+		DropOnStatus:     config.DropOnStatus,
+		SuccessOnStatus:  config.SuccessOnStatus,
+		DeadLetterPath:   config.DeadLetterPath,
+		Method:           config.Method,
+		MethodField:      config.MethodField,
+		MethodMap:        config.MethodMap,
+		SampleRate:       config.SampleRate,
+		SampleField:      config.SampleField,
+		Concurrency:      concurrency,
+		BodyField:        config.BodyField,
+		OnNonObject:      config.OnNonObject,
+		NonObjectField:   config.NonObjectField,
+		ContentTypeField: config.ContentTypeField,
+		CaptureField:     config.CaptureField,
+		CaptureIDField:   config.CaptureIDField,
+		CapturePath:      config.CapturePath,
+		LogFailureFields: config.LogFailureFields,
+		ProxyProtocol:    config.ProxyProtocol,
+		Resolve:          resolve,
+		NoKeepAlives:     config.NoKeepAlives,
+		ShareTransport:   config.ShareTransport,
+		DataStreamPath:   config.DataStreamPath,
+		DynamicPath:      config.DynamicPath,
+		PathMissing:      config.PathMissing,
+		PathLowercase:    config.PathLowercase,
+		ClusterField:     config.ClusterField,
+		ClusterMap:       config.ClusterMap,
+		ClusterMissing:   config.ClusterMissing,
+		TrailerStatus:    config.TrailerStatus,
+		TrailerSuccess:   config.TrailerSuccess,
+		TETrailers:       config.TETrailers,
+		StreamMarker:     streamMarker,
+		StreamSuccess:    config.Response.SuccessValues,
+		AcceptedField:    config.Response.AcceptedField,
+		RejectedField:    config.Response.RejectedField,
+		RejectedRetries:  config.Response.RejectedRetries,
+		BatchHistograms:  config.BatchHistograms,
+		MaxPending:       config.MaxPending,
+		MinBatchSize:     config.MinBatchSize,
+		FlushInterval:    config.FlushInterval,
+		ShutdownTimeout:  config.ShutdownTimeout,
+		RetryOnEOF:       config.RetryOnEOF,
+		Prewarm:          config.Prewarm,
+		PrettyBody:       config.PrettyBody,
+		RequestDelay:     config.RequestDelay,
+		StatefulHeader:   config.StatefulHeader,
+		Bootstrap:        config.Bootstrap,
+		SlowRequest:      config.SlowRequest,
+		TransferEncoding: config.TransferEncoding,
+		ChunkThreshold:   config.ChunkThreshold,
+		WarnBodyBytes:    config.WarnBodyBytes,
+		WarnBodyRaw:      config.WarnBodySize == "raw",
+		TrailingNewline:  config.TrailingNewline,
+		ContentMD5:       config.ContentMD5,
+		HTTP10:           config.HTTPVersion == "1.0",
+		health:           health,
+		limiter:          limiter,
+		drops:            drops,
+		jwt:              jwt,
+		oauth2:           oauth2,
+		guard:            guard,
+		backpressure:     pressure,
+		script:           script,
+		credentials:      credentials,
+	}
 	clients := make([]outputs.NetworkClient, len(hosts))
+	var fanout []*Client
+	// hosts are listed once per worker, the workers of a host share its slots
+	connSlots := map[string]chan struct{}{}
+	// the self test sends one request per host, not per worker
+	var selfTested []*Client
+	tested := map[string]bool{}
 	for i, host := range hosts {
 		logger.Info("Making client for host: " + host)
-		hostURL, err := common.MakeURL(config.Protocol, config.Path, host, 80)
+		if config.MaxConnsPerHost > 0 && connSlots[host] == nil {
+			connSlots[host] = make(chan struct{}, config.MaxConnsPerHost)
+		}
+		hostURL, err := common.MakeURL(config.Protocol, config.Path, normalizeHost(config.Protocol, host), 80)
 		if err != nil {
 			logger.Error("Invalid host param set: %s, Error: %v", host, err)
 			return outputs.Fail(err)
 		}
 		logger.Info("Final host URL: " + hostURL)
-		var client outputs.NetworkClient
-		client, err = NewClient(ClientSettings{
-			URL:              hostURL,
-			Proxy:            proxyURL,
-			TLS:              tlsConfig,
-			Username:         config.Username,
-			Password:         config.Password,
-			Parameters:       params,
-			Timeout:          config.Timeout,
-			CompressionLevel: config.CompressionLevel,
-			Observer:         observer,
-			BatchPublish:     config.BatchPublish,
-			Headers:          config.Headers,
-			ContentType:      config.ContentType,
-			Format:           config.Format,
-		})
+		settings := base
+		settings.URL = hostURL
+		settings.Timeout = config.timeout(host)
+		settings.JSONIndent = config.indent(host)
+		settings.connSlots = connSlots[host]
+		settings.fanoutHost = config.Fanout
+		client, err := NewClient(settings)
 
 		if err != nil {
 			return outputs.Fail(err)
 		}
-		client = outputs.WithBackoff(client, config.Backoff.Init, config.Backoff.Max)
-		clients[i] = client
+		if !tested[host] {
+			tested[host] = true
+			selfTested = append(selfTested, client)
+		}
+		if config.Fanout {
+			fanout = append(fanout, client)
+			continue
+		}
+		clients[i] = withBackoff(client, config.Backoff)
+	}
+	if config.Fanout {
+		settings := base
+		settings.URL = fanout[0].URL
+		report, err := NewClient(settings)
+		if err != nil {
+			return outputs.Fail(err)
+		}
+		client := newFanoutClient(fanout, config.FanoutRequire, report)
+		clients = []outputs.NetworkClient{
+			withBackoff(client, config.Backoff),
+		}
+	}
+	if config.SelfTest.Enabled {
+		if err := runSelfTest(config.SelfTest, selfTested); err != nil {
+			return outputs.Fail(err)
+		}
 	}
 	return outputs.SuccessNet(config.LoadBalance, config.BatchSize, config.MaxRetries, clients)
 }
+
+// uniqueHosts returns hosts without repetitions, keeping their order.
+func uniqueHosts(hosts []string) []string {
+	seen := make(map[string]struct{}, len(hosts))
+	unique := hosts[:0:0]
+	for _, host := range hosts {
+		if _, ok := seen[host]; !ok {
+			seen[host] = struct{}{}
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
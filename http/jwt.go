@@ -0,0 +1,167 @@
+package http
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	// register the hash functions used by the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+type jwtConfig struct {
+	PrivateKey string                 `config:"private_key"`
+	Algorithm  string                 `config:"algorithm"`
+	Claims     map[string]interface{} `config:"claims"`
+	TTL        time.Duration          `config:"ttl"`
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtSigner mints JWTs signed with a private key and caches them until
+// shortly before they expire. It is shared by all clients of an output.
+type jwtSigner struct {
+	key    crypto.Signer
+	alg    string
+	hash   crypto.Hash
+	claims map[string]interface{}
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	token   string
+	refresh time.Time
+}
+
+func newJWTSigner(c jwtConfig) (*jwtSigner, error) {
+	hash, ok := jwtHashes[c.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported jwt algorithm: %s", c.Algorithm)
+	}
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		if c.Algorithm[:2] != "RS" {
+			return nil, fmt.Errorf("jwt algorithm %s requires an EC key", c.Algorithm)
+		}
+	case *ecdsa.PrivateKey:
+		if c.Algorithm[:2] != "ES" {
+			return nil, fmt.Errorf("jwt algorithm %s requires an RSA key", c.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported jwt private key type %T", key)
+	}
+	return &jwtSigner{key: key, alg: c.Algorithm, hash: hash, claims: c.Claims, ttl: c.TTL}, nil
+}
+
+func loadPrivateKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T in %s", key, file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("failed to parse private key in %s", file)
+}
+
+// Token returns the cached token, minting a new one once 80% of its
+// lifetime passed.
+func (s *jwtSigner) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Before(s.refresh) {
+		return s.token, nil
+	}
+	token, err := s.sign(now)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.refresh = now.Add(s.ttl * 4 / 5)
+	return token, nil
+}
+
+func (s *jwtSigner) sign(now time.Time) (string, error) {
+	claims := make(map[string]interface{}, len(s.claims)+2)
+	for k, v := range s.claims {
+		claims[k] = v
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(s.ttl).Unix()
+
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("invalid jwt claims: %v", err)
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+
+	h := s.hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, s.hash, digest)
+	case *ecdsa.PrivateKey:
+		sig, err = signECDSA(key, digest)
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// signECDSA returns the signature in the fixed size r || s form JWS uses.
+func signECDSA(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rb):size], rb)
+	copy(sig[2*size-len(sb):], sb)
+	return sig, nil
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJWTFailureRetries(t *testing.T) {
+	doer := &fakeDoer{}
+	observer := &fakeObserver{}
+	client := newTestClient(t, ClientSettings{Observer: observer}, doer)
+	// claims that can't be encoded fail minting every token
+	client.jwt = &jwtSigner{
+		alg:    "RS256",
+		hash:   crypto.SHA256,
+		claims: map[string]interface{}{"bad": func() {}},
+		ttl:    time.Minute,
+	}
+	batch := &fakeBatch{events: testEvents(2)}
+	err := client.Publish(context.Background(), batch)
+	assertRetried(t, batch, observer, err)
+	if !errors.Is(err, ErrBearerToken) {
+		t.Errorf("got %v, want %v", err, ErrBearerToken)
+	}
+	if doer.count() != 0 {
+		t.Errorf("%d requests sent without token", doer.count())
+	}
+}
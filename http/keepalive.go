@@ -0,0 +1,120 @@
+package http
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// keepalive periodically sends a lightweight request while no events are
+// published, to keep sessions and connections with the sink alive. The
+// health check uses it too, but is never touched and so probes every
+// interval.
+type keepalive struct {
+	interval time.Duration
+	method   string
+	path     string
+	// emptyBody sends an empty body with Content-Length: 0
+	emptyBody bool
+
+	mu   sync.Mutex
+	last time.Time
+	done chan struct{}
+}
+
+func newKeepalive(interval time.Duration, method, path string, emptyBody bool) *keepalive {
+	return &keepalive{
+		interval:  interval,
+		method:    method,
+		path:      path,
+		emptyBody: emptyBody,
+		last:      time.Now(),
+	}
+}
+
+// touch records activity on the connection.
+func (k *keepalive) touch() {
+	k.mu.Lock()
+	k.last = time.Now()
+	k.mu.Unlock()
+}
+
+func (k *keepalive) idle() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return time.Since(k.last)
+}
+
+func (k *keepalive) start(ping func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.done != nil {
+		return
+	}
+	k.done = make(chan struct{})
+	go k.run(k.done, ping)
+}
+
+func (k *keepalive) stop() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.done != nil {
+		close(k.done)
+		k.done = nil
+	}
+}
+
+func (k *keepalive) run(done <-chan struct{}, ping func()) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if k.idle() >= k.interval {
+				ping()
+				k.touch()
+			}
+		}
+	}
+}
+
+// sendKeepalive sends the keepalive request. Failures are only logged, they
+// are left to the next publish to detect.
+func (client *Client) sendKeepalive() {
+	if urlStr, err := client.probe(client.keepalive); err != nil {
+		logger.Debugf("Keepalive request to %s failed: %v", urlStr, err)
+	}
+}
+
+// sendHealthCheck sends the health check request and logs failures.
+func (client *Client) sendHealthCheck() {
+	if urlStr, err := client.probe(client.healthCheck); err != nil {
+		logger.Warnf("Health check of %s failed: %v", urlStr, err)
+	}
+}
+
+// probe sends the request described by k to the URL it returns.
+func (client *Client) probe(k *keepalive) (string, error) {
+	urlStr := addToURL(joinURLPath(client.URL, k.path), client.params)
+	req, err := http.NewRequest(k.method, urlStr, nil)
+	if err != nil {
+		return urlStr, err
+	}
+	if err := client.authorize(req, client.headers); err != nil {
+		return urlStr, err
+	}
+	if k.emptyBody {
+		// sent like a publish request without events, which some gateways
+		// take as a health ping. Only the Content-Type of the encoder
+		// applies, there is no body to compress.
+		req.Body = http.NoBody
+		req.ContentLength = 0
+		header := http.Header{}
+		client.encoder.AddHeader(&header, client.ContentType)
+		req.Header.Set("Content-Type", header.Get("Content-Type"))
+	}
+	_, _, err = client.roundTrip(req)
+	return urlStr, err
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepaliveHeaders(t *testing.T) {
+	doer := &fakeDoer{}
+	s := ClientSettings{
+		KeepaliveEvery:  time.Hour,
+		KeepaliveMethod: "GET",
+		KeepalivePath:   "/ping",
+		Headers:         map[string]string{"X-Tenant": "acme"},
+	}
+	client := newTestClient(t, s, doer)
+	client.oauth2 = &oauth2Source{token: "secret", refresh: time.Now().Add(time.Hour)}
+	client.state = newStatefulHeader(statefulConfig{ResponseHeader: "X-Next", RequestHeader: "X-Token"})
+	client.state.value = "cursor"
+
+	client.sendKeepalive()
+	if doer.count() != 1 {
+		t.Fatalf("sent %d keepalive requests, want 1", doer.count())
+	}
+	header := doer.requests[0].Header
+	for key, want := range map[string]string{
+		"Authorization": "Bearer secret",
+		"X-Token":       "cursor",
+		"X-Tenant":      "acme",
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestHealthCheckEmptyBody(t *testing.T) {
+	doer := &fakeDoer{}
+	s := ClientSettings{
+		BatchPublish:     true,
+		CompressionLevel: 5,
+		HealthEvery:      time.Hour,
+		HealthMethod:     "POST",
+		HealthEmptyBody:  true,
+	}
+	client := newTestClient(t, s, doer)
+
+	client.sendHealthCheck()
+	if doer.count() != 1 {
+		t.Fatalf("sent %d health check requests, want 1", doer.count())
+	}
+	req := doer.requests[0]
+	if req.Method != "POST" || req.URL.Path != "/ingest" {
+		t.Errorf("sent %s %s, want POST /ingest", req.Method, req.URL.Path)
+	}
+	if req.ContentLength != 0 || doer.bodies[0] != "" {
+		t.Errorf("sent Content-Length %d and body %q, want an empty body", req.ContentLength, doer.bodies[0])
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json; charset=UTF-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := req.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want none for an empty body", got)
+	}
+}
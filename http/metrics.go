@@ -0,0 +1,225 @@
+package http
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+var (
+	// eventsTotal counts events handed to the output, batchesTotal the
+	// batches they arrived in, requestsTotal the HTTP requests sent and
+	// bytesSentTotal the request body bytes sent, after compression.
+	eventsTotal    = expvar.NewInt("output.http.events_total")
+	batchesTotal   = expvar.NewInt("output.http.batches_total")
+	requestsTotal  = expvar.NewInt("output.http.requests_total")
+	bytesSentTotal = expvar.NewInt("output.http.bytes_sent_total")
+
+	// eventsDeduplicated counts events dropped because an earlier event in
+	// the same batch had the same dedup_field value.
+	eventsDeduplicated = expvar.NewInt("output.http.events.deduplicated")
+	// eventsCoalesced counts events merged into another event of their
+	// batch by coalesce_fields.
+	eventsCoalesced = expvar.NewInt("output.http.events.coalesced")
+	// eventsDroppedHostsDown counts events dropped because all hosts were
+	// down for longer than max_pending_duration.
+	eventsDroppedHostsDown = expvar.NewInt("output.http.events.dropped_hosts_down")
+	// eventsDroppedTooLarge counts events dropped after the server kept
+	// rejecting them as too large.
+	eventsDroppedTooLarge = expvar.NewInt("output.http.events.dropped_too_large")
+	// eventsDeadLettered counts events written to the dead letter file.
+	eventsDeadLettered = expvar.NewInt("output.http.events.dead_lettered")
+	// eventsExpired counts events dropped for being older than max_event_age.
+	eventsExpired = expvar.NewInt("output.http.events.expired")
+	// eventsSampledOut counts events dropped by sampling.
+	eventsSampledOut = expvar.NewInt("output.http.events.sampled_out")
+	// eventsOverBudget counts events given up on after being retried for
+	// longer than retry_budget.
+	eventsOverBudget = expvar.NewInt("output.http.events.retry_budget_exceeded")
+	// eventsOverMaxHosts counts events given up on after failing on
+	// max_hosts_per_publish hosts.
+	eventsOverMaxHosts = expvar.NewInt("output.http.events.max_hosts_exceeded")
+	// eventsOverMaxRetries counts events given up on after max_retries
+	// retries with drop_after_max_retries.
+	eventsOverMaxRetries = expvar.NewInt("output.http.events.max_retries_exceeded")
+	// eventsScriptDropped counts events dropped because transform_script
+	// failed on them.
+	eventsScriptDropped = expvar.NewInt("output.http.events.script_dropped")
+	// retriesTotal counts publish attempts whose events are retried and
+	// eventsRetried the events retried.
+	retriesTotal  = expvar.NewInt("output.http.retries_total")
+	eventsRetried = expvar.NewInt("output.http.events.retried")
+	// requestsInFlight is the number of HTTP requests currently in progress.
+	requestsInFlight = expvar.NewInt("output.http.requests.in_flight")
+	// queueDepth is the number of events handed to the output and not yet
+	// published, retried or dropped, including those waiting for a
+	// connection slot or the rate limit.
+	queueDepth = expvar.NewInt("output.http.queue_depth")
+	// compressionBytesIn and compressionBytesOut count the bytes of
+	// compressed request bodies before and after compression, so their
+	// quotient is the average compression ratio. compressionRatioLast is the
+	// ratio of the last compressed body.
+	compressionBytesIn   = expvar.NewInt("output.http.compression.bytes_in")
+	compressionBytesOut  = expvar.NewInt("output.http.compression.bytes_out")
+	compressionRatioLast = expvar.NewFloat("output.http.compression.ratio_last")
+
+	// histograms describing the distribution of published request bodies,
+	// only updated when batch_histograms is enabled.
+	batchEventsHistogram = newHistogram("output.http.batch.events",
+		[]float64{1, 10, 50, 100, 250, 500, 1000, 2500, 5000})
+	batchBytesHistogram = newHistogram("output.http.batch.bytes",
+		[]float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20})
+	compressionRatioHistogram = newHistogram("output.http.batch.compression_ratio",
+		[]float64{1, 1.5, 2, 3, 4, 6, 8, 12, 16})
+	// batchRetriesHistogram describes how often batches were retried before
+	// they were published successfully.
+	batchRetriesHistogram = newHistogram("output.http.batch.retries",
+		[]float64{0, 1, 2, 3, 5, 10, 20, 50})
+)
+
+// dropCounters are the counters of the reasons events are dropped for, see
+// dropEvents. Events given up on after retrying are counted when they are
+// given up on, whether they are dropped or dead-lettered.
+var dropCounters = map[string]*expvar.Int{
+	"duplicate":        eventsDeduplicated,
+	"expired":          eventsExpired,
+	"hosts_down":       eventsDroppedHostsDown,
+	"sampled":          eventsSampledOut,
+	"too_large":        eventsDroppedTooLarge,
+	"transform_script": eventsScriptDropped,
+}
+
+// retriesKey is the EventCache key counting how often an event was retried,
+// firstRetryKey the one holding the time of its first retry and
+// triedHostsKey the one listing the hosts it failed on.
+const (
+	retriesKey    = "http.retries"
+	firstRetryKey = "http.first_retry"
+	triedHostsKey = "http.tried_hosts"
+)
+
+// countRetries records that events are about to be retried.
+func countRetries(events []publisher.Event, observer outputs.Observer) {
+	retriesTotal.Add(1)
+	eventsRetried.Add(int64(len(events)))
+	if observer != nil {
+		observer.Failed(len(events))
+	}
+	now := time.Now()
+	for i := range events {
+		events[i].Cache.Put(retriesKey, eventRetries(&events[i])+1)
+		if _, err := events[i].Cache.GetValue(firstRetryKey); err != nil {
+			events[i].Cache.Put(firstRetryKey, now)
+		}
+	}
+}
+
+// observeRetries records how often the events of a successfully published
+// batch were retried, going by its first event.
+func observeRetries(events []publisher.Event) {
+	if len(events) > 0 {
+		batchRetriesHistogram.Observe(float64(eventRetries(&events[0])))
+	}
+}
+
+// retryingFor returns how long ago the event was first retried, or 0 if it
+// was not retried yet.
+func retryingFor(event *publisher.Event) time.Duration {
+	value, err := event.Cache.GetValue(firstRetryKey)
+	if err != nil {
+		return 0
+	}
+	first, ok := value.(time.Time)
+	if !ok {
+		return 0
+	}
+	return time.Since(first)
+}
+
+func eventRetries(event *publisher.Event) int {
+	value, err := event.Cache.GetValue(retriesKey)
+	if err != nil {
+		return 0
+	}
+	retries, _ := value.(int)
+	return retries
+}
+
+// histogram is a fixed-bucket histogram that can be published with expvar.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newHistogram(name string, bounds []float64) *histogram {
+	h := &histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+	expvar.Publish(name, h)
+	return h
+}
+
+// Observe adds v to the first bucket whose upper bound is >= v.
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// String implements expvar.Var. Bucket counts are cumulative, keyed by their
+// upper bound.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.counts))
+	var cumulative int64
+	for i, n := range h.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		buckets[le] = cumulative
+	}
+	b, _ := json.Marshal(struct {
+		Count   int64            `json:"count"`
+		Sum     float64          `json:"sum"`
+		Buckets map[string]int64 `json:"buckets"`
+	}{h.count, h.sum, buckets})
+	return string(b)
+}
+
+// observeCompression records the sizes of a compressed request body.
+func observeCompression(raw, compressed int) {
+	compressionBytesIn.Add(int64(raw))
+	compressionBytesOut.Add(int64(compressed))
+	if compressed > 0 {
+		compressionRatioLast.Set(float64(raw) / float64(compressed))
+	}
+}
+
+// observeBody records the size distribution of an encoded request body.
+func observeBody(events, raw, encoded int) {
+	batchEventsHistogram.Observe(float64(events))
+	batchBytesHistogram.Observe(float64(encoded))
+	if encoded > 0 {
+		compressionRatioHistogram.Observe(float64(raw) / float64(encoded))
+	}
+}
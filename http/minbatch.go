@@ -0,0 +1,191 @@
+package http
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+// heldBatches holds published batches until together they contain at least
+// minEvents events or the oldest was held for flushInterval, and then sends
+// them in one go. If sending fails all held batches are retried, including
+// events the server may have accepted already.
+type heldBatches struct {
+	minEvents     int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	batches []publisher.Batch
+	events  int
+	timer   *time.Timer
+	// flushErr is the error of the last flush by the timer, it is returned
+	// by the next Publish so the output backs off
+	flushErr error
+
+	// sendMu serializes flushes triggered by Publish and by the timer
+	sendMu sync.Mutex
+}
+
+func newHeldBatches(minEvents int, flushInterval time.Duration) *heldBatches {
+	return &heldBatches{minEvents: minEvents, flushInterval: flushInterval}
+}
+
+// add holds batch. It returns the batches to be sent now if the minimum
+// number of events is reached.
+func (h *heldBatches) add(batch publisher.Batch, flush func()) []publisher.Batch {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.batches = append(h.batches, batch)
+	h.events += len(batch.Events())
+	if h.events >= h.minEvents {
+		return h.takeLocked()
+	}
+	if h.timer == nil {
+		h.timer = time.AfterFunc(h.flushInterval, flush)
+	}
+	return nil
+}
+
+// take removes and returns all held batches.
+func (h *heldBatches) take() []publisher.Batch {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.takeLocked()
+}
+
+// setFlushErr records the error of a flush by the timer.
+func (h *heldBatches) setFlushErr(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.flushErr = err
+}
+
+// takeFlushErr returns and clears the error of the last flush by the timer.
+func (h *heldBatches) takeFlushErr() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.flushErr
+	h.flushErr = nil
+	return err
+}
+
+func (h *heldBatches) takeLocked() []publisher.Batch {
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	batches := h.batches
+	h.batches, h.events = nil, 0
+	return batches
+}
+
+// publishHeld holds batch, sending all held batches once enough events
+// accumulated.
+func (client *Client) publishHeld(batch publisher.Batch) error {
+	batches := client.held.add(batch, client.flushHeld)
+	if len(batches) == 0 {
+		return client.held.takeFlushErr()
+	}
+	return client.sendHeld(batches)
+}
+
+// flushHeld sends all held batches regardless of their size.
+func (client *Client) flushHeld() {
+	if batches := client.held.take(); len(batches) > 0 {
+		client.held.setFlushErr(client.sendHeld(batches))
+	}
+}
+
+// drainHeld sends all held batches on shutdown, waiting at most
+// shutdown_timeout. Events that could not be sent in time or failed are
+// dead-lettered if on_failure is dead_letter, and retried otherwise.
+func (client *Client) drainHeld() {
+	batches := client.held.take()
+	if len(batches) == 0 {
+		return
+	}
+	var events []publisher.Event
+	for _, batch := range batches {
+		events = append(events, batch.Events()...)
+	}
+
+	type result struct {
+		rest []publisher.Event
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// wait for a flush triggered by the timer to finish first
+		client.held.sendMu.Lock()
+		defer client.held.sendMu.Unlock()
+		rest, err := client.publishEvents(events)
+		done <- result{rest, err}
+	}()
+
+	var timeout <-chan time.Time
+	if client.shutdownTimeout > 0 {
+		timer := time.NewTimer(client.shutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var r result
+	select {
+	case r = <-done:
+	case <-timeout:
+		// abort the requests and settle the batches once they returned, so
+		// none of them is still sent while it is retried
+		client.abortRequests()
+		r = <-done
+		if len(r.rest) > 0 {
+			r.err = fmt.Errorf("%w: %v", ErrShutdownTimeout, r.err)
+		}
+	}
+	rest, err := r.rest, r.err
+	if len(rest) == 0 {
+		client.settleHeld(batches, nil, err)
+		return
+	}
+	if client.deadLetter == nil {
+		logger.Warnf("Failed to send %d of %d held events on shutdown: %v", len(rest), len(events), err)
+		client.settleHeld(batches, rest, err)
+		return
+	}
+	logger.Warnf("Dead-lettering %d of %d held events not sent on shutdown: %v", len(rest), len(events), err)
+	client.deadLetter.Write(rest, err)
+	for _, batch := range batches {
+		batch.ACK()
+	}
+}
+
+func (client *Client) sendHeld(batches []publisher.Batch) error {
+	client.held.sendMu.Lock()
+	defer client.held.sendMu.Unlock()
+
+	var events []publisher.Event
+	for _, batch := range batches {
+		events = append(events, batch.Events()...)
+	}
+	rest, err := client.publishEvents(events)
+	if len(rest) > 0 {
+		logger.Debugf("Retrying %d held batches, %d of %d events failed.", len(batches), len(rest), len(events))
+	}
+	return client.settleHeld(batches, rest, err)
+}
+
+// settleHeld settles each of batches like Publish settles a batch. If any
+// of their events failed, all events of all batches are retried.
+func (client *Client) settleHeld(batches []publisher.Batch, rest []publisher.Event, err error) error {
+	client.markHealth(len(rest) == 0)
+	for _, batch := range batches {
+		var failed []publisher.Event
+		if len(rest) > 0 {
+			failed = batch.Events()
+		}
+		client.settle(batch, batch.Events(), failed, err)
+	}
+	return err
+}
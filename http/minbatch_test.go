@@ -0,0 +1,121 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func failingDoer() *fakeDoer {
+	return &fakeDoer{respond: func(*http.Request) (*http.Response, error) {
+		return response(http.StatusServiceUnavailable, ""), nil
+	}}
+}
+
+func TestHeldBatchesOverMaxRetries(t *testing.T) {
+	s := ClientSettings{BatchPublish: true, MinBatchSize: 2, FlushInterval: time.Hour, DropAfterMax: true}
+	client := newTestClient(t, s, failingDoer())
+	first, second := &fakeBatch{events: testEvents(1)}, &fakeBatch{events: testEvents(1)}
+	if err := client.Publish(context.Background(), first); err != nil {
+		t.Fatalf("held batch failed: %v", err)
+	}
+	if err := client.Publish(context.Background(), second); err == nil {
+		t.Fatal("no error for failed held batches")
+	}
+	for i, batch := range []*fakeBatch{first, second} {
+		if !batch.dropped || len(batch.retried) != 0 {
+			t.Errorf("batch %d: dropped %v, retried %d events, want dropped", i, batch.dropped, len(batch.retried))
+		}
+	}
+}
+
+func TestHeldBatchesFlushFailure(t *testing.T) {
+	s := ClientSettings{BatchPublish: true, MinBatchSize: 10, FlushInterval: 10 * time.Millisecond}
+	client := newTestClient(t, s, failingDoer())
+	batch := &fakeBatch{events: testEvents(1)}
+	client.Publish(context.Background(), batch)
+
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); err == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		err = client.held.takeFlushErr()
+	}
+	if err == nil {
+		t.Fatal("held batch not flushed")
+	}
+	if len(batch.retried) != 1 {
+		t.Errorf("retried %d events, want 1", len(batch.retried))
+	}
+
+	client.held.setFlushErr(err)
+	if perr := client.Publish(context.Background(), &fakeBatch{events: testEvents(1)}); perr != err {
+		t.Errorf("Publish returned %v, want the flush error %v", perr, err)
+	}
+}
+
+func TestDrainHeldTimeout(t *testing.T) {
+	var returned int32
+	doer := &fakeDoer{respond: func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(&returned) == 0 {
+			<-req.Context().Done()
+			atomic.StoreInt32(&returned, 1)
+			return nil, req.Context().Err()
+		}
+		return response(http.StatusOK, "{}"), nil
+	}}
+	s := ClientSettings{BatchPublish: true, MinBatchSize: 10, FlushInterval: time.Hour, ShutdownTimeout: 20 * time.Millisecond}
+	client := newTestClient(t, s, doer)
+	batch := &fakeBatch{events: testEvents(1)}
+	client.Publish(context.Background(), batch)
+	client.Close()
+
+	if atomic.LoadInt32(&returned) == 0 {
+		t.Fatal("batch settled while its request was still in flight")
+	}
+	if len(batch.retried) != 1 {
+		t.Errorf("retried %d events, want 1", len(batch.retried))
+	}
+
+	// requests work again after reconnecting
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	batch = &fakeBatch{events: testEvents(10)}
+	if err := client.Publish(context.Background(), batch); err != nil || !batch.acked {
+		t.Errorf("publish after reconnect: acked %v, err %v", batch.acked, err)
+	}
+}
+
+func TestDrainHeldTimeoutReconnect(t *testing.T) {
+	doer := bootstrapDoer()
+	inner := doer.respond
+	var blocked int32
+	doer.respond = func(req *http.Request) (*http.Response, error) {
+		// the first batch hangs until it is aborted
+		if req.URL.Path == "/ingest" && atomic.CompareAndSwapInt32(&blocked, 0, 1) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return inner(req)
+	}
+	s := ClientSettings{
+		BatchPublish:    true,
+		MinBatchSize:    10,
+		FlushInterval:   time.Hour,
+		ShutdownTimeout: 20 * time.Millisecond,
+		Bootstrap:       testBootstrap,
+	}
+	client := newTestClient(t, s, doer)
+	client.Publish(context.Background(), &fakeBatch{events: testEvents(1)})
+	client.Close()
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("reconnect after shutdown timeout: %v", err)
+	}
+	batch := &fakeBatch{events: testEvents(10)}
+	if err := client.Publish(context.Background(), batch); err != nil || !batch.acked {
+		t.Errorf("publish after reconnect: acked %v, err %v", batch.acked, err)
+	}
+}
@@ -0,0 +1,125 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+)
+
+type oauth2Config struct {
+	TokenURL     string   `config:"token_url"`
+	ClientID     string   `config:"client_id"`
+	ClientSecret string   `config:"client_secret"`
+	Scopes       []string `config:"scopes"`
+	// SSL configures the connection to the token endpoint, independent of
+	// the tls settings of the output.
+	SSL *tlscommon.Config `config:"ssl"`
+}
+
+// oauth2Source fetches access tokens with the OAuth2 client credentials
+// grant and caches them until shortly before they expire. It is shared by
+// all clients of an output.
+type oauth2Source struct {
+	config oauth2Config
+	http   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	refresh time.Time
+}
+
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func newOAuth2Source(c oauth2Config, timeout time.Duration, guard *addressGuard) (*oauth2Source, error) {
+	tlsConfig, err := tlscommon.LoadTLSConfig(c.SSL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oauth2.ssl settings: %v", err)
+	}
+	var dialer transport.Dialer = transport.NetDialer(timeout)
+	proxy := http.ProxyFromEnvironment
+	if guard != nil {
+		dialer = guardedDialer(dialer, guard)
+		proxy = nil
+	}
+	tlsDialer := transport.TLSDialer(dialer, tlsConfig, timeout)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:    dialer.Dial,
+			DialTLS: tlsDialer.Dial,
+			Proxy:   proxy,
+		},
+		Timeout: timeout,
+	}
+	return &oauth2Source{config: c, http: client}, nil
+}
+
+// Token returns the cached access token, fetching a new one once 80% of
+// its lifetime passed.
+func (s *oauth2Source) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Before(s.refresh) {
+		return s.token, nil
+	}
+	token, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		// the server didn't say, ask again soon
+		lifetime = time.Minute
+	}
+	s.token = token.AccessToken
+	s.refresh = now.Add(lifetime * 4 / 5)
+	return s.token, nil
+}
+
+func (s *oauth2Source) fetch() (*oauth2Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, s.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closing(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint %s responded with %s: %s", s.config.TokenURL, resp.Status, body)
+	}
+	var token oauth2Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response from %s has no access_token", s.config.TokenURL)
+	}
+	return &token, nil
+}
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestOAuth2FailureRetries(t *testing.T) {
+	for name, respond := range map[string]roundTripFunc{
+		"token endpoint error": func(*http.Request) (*http.Response, error) {
+			return response(http.StatusInternalServerError, "unavailable"), nil
+		},
+		"tls failure": func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("remote error: tls: bad certificate")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			doer := &fakeDoer{}
+			observer := &fakeObserver{}
+			client := newTestClient(t, ClientSettings{BatchPublish: true, Observer: observer}, doer)
+			client.oauth2 = &oauth2Source{
+				config: oauth2Config{TokenURL: "https://auth.example.com/token"},
+				http:   &http.Client{Transport: respond},
+			}
+			batch := &fakeBatch{events: testEvents(2)}
+			err := client.Publish(context.Background(), batch)
+			assertRetried(t, batch, observer, err)
+			if !errors.Is(err, ErrBearerToken) {
+				t.Errorf("got %v, want %v", err, ErrBearerToken)
+			}
+			if doer.count() != 0 {
+				t.Errorf("%d requests sent without token", doer.count())
+			}
+		})
+	}
+}
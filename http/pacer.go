@@ -0,0 +1,67 @@
+package http
+
+import (
+	"sync"
+	"time"
+)
+
+// pacer spaces requests at least delay apart. Waiting requests are released
+// when the pacer is stopped, so closing the client is not delayed.
+type pacer struct {
+	delay time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+	done chan struct{}
+}
+
+func newPacer(delay time.Duration) *pacer {
+	return &pacer{delay: delay, done: make(chan struct{})}
+}
+
+// wait blocks until the next request may be sent. It returns false if the
+// pacer was stopped while waiting.
+func (p *pacer) wait() bool {
+	p.mu.Lock()
+	now := time.Now()
+	slot := p.next
+	if slot.Before(now) {
+		slot = now
+	}
+	p.next = slot.Add(p.delay)
+	done := p.done
+	p.mu.Unlock()
+
+	d := time.Until(slot)
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (p *pacer) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		p.done = make(chan struct{})
+	default:
+	}
+}
+
+func (p *pacer) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+}
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPacedRequestRetriedOnClose(t *testing.T) {
+	doer := &fakeDoer{}
+	observer := &fakeObserver{}
+	client := newTestClient(t, ClientSettings{RequestDelay: time.Hour, Observer: observer}, doer)
+	if err := client.Publish(context.Background(), &fakeBatch{events: testEvents(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next request waits an hour for its turn, until the client closes
+	batch := &fakeBatch{events: testEvents(1)}
+	done := make(chan error)
+	go func() {
+		done <- client.Publish(context.Background(), batch)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't release the waiting request")
+	}
+	if err == nil || batch.acked || len(batch.retried) != 1 {
+		t.Errorf("got err %v, acked %v, %d retried", err, batch.acked, len(batch.retried))
+	}
+	if observer.acked != 1 {
+		t.Errorf("%d events reported acked, want 1", observer.acked)
+	}
+	if doer.count() != 1 {
+		t.Errorf("%d requests sent, want 1", doer.count())
+	}
+}
@@ -0,0 +1,131 @@
+package http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// loadProtoMessage reads a serialized FileDescriptorSet, as written by
+// `protoc --descriptor_set_out --include_imports`, and looks up the message
+// events are encoded as.
+func loadProtoMessage(descriptorFile, name string) (protoreflect.MessageDescriptor, error) {
+	b, err := ioutil.ReadFile(descriptorFile)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse protobuf descriptor %s: %v", descriptorFile, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf descriptor %s: %v", descriptorFile, err)
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("protobuf message %s: %v", name, err)
+	}
+	message, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a protobuf message", name)
+	}
+	return message, nil
+}
+
+// protobufEncoder encodes events as protobuf messages in gRPC-Web framing.
+// Event fields are mapped to message fields by their JSON names, fields
+// without a counterpart in the message are ignored. A batch is sent as a
+// stream of messages.
+type protobufEncoder struct {
+	buf     *bytes.Buffer
+	message protoreflect.MessageDescriptor
+	raw     int
+}
+
+func newProtobufEncoder(message protoreflect.MessageDescriptor) *protobufEncoder {
+	return &protobufEncoder{buf: bytes.NewBuffer(nil), message: message}
+}
+
+func (b *protobufEncoder) Reset() {
+	b.buf.Reset()
+	b.raw = 0
+}
+
+func (b *protobufEncoder) AddHeader(header *http.Header, contentType string) {
+	if contentType == "" {
+		contentType = "application/grpc-web+proto"
+	}
+	header.Add("Content-Type", contentType)
+}
+
+func (b *protobufEncoder) Reader() io.Reader {
+	return b.buf
+}
+
+func (b *protobufEncoder) Sizes() (int, int) {
+	return b.raw, b.buf.Len()
+}
+
+func (b *protobufEncoder) Marshal(obj interface{}) error {
+	b.Reset()
+	if events, ok := obj.([]eventRaw); ok {
+		for _, event := range events {
+			if err := b.AddRaw(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return b.AddRaw(obj)
+}
+
+// MarshalRaw frames body, which must already be a serialized message.
+func (b *protobufEncoder) MarshalRaw(body []byte) error {
+	b.Reset()
+	b.raw = len(body)
+	b.writeFrame(body)
+	return nil
+}
+
+func (b *protobufEncoder) AddRaw(raw interface{}) error {
+	doc, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	msg := dynamicpb.NewMessage(b.message)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(doc, msg); err != nil {
+		return err
+	}
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	b.raw += len(doc)
+	b.writeFrame(body)
+	return nil
+}
+
+func (b *protobufEncoder) Add(meta, obj interface{}) error {
+	return b.AddRaw(obj)
+}
+
+// writeFrame writes a gRPC-Web data frame: a zero flags byte, the big
+// endian message length and the message.
+func (b *protobufEncoder) writeFrame(message []byte) {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+	b.buf.Write(header[:])
+	b.buf.Write(message)
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+)
+
+// proxyProtocolDialer wraps d to send a PROXY protocol v1 header on every new
+// connection, before any TLS handshake or HTTP request.
+func proxyProtocolDialer(d transport.Dialer) transport.Dialer {
+	return transport.DialerFunc(func(network, address string) (net.Conn, error) {
+		conn, err := d.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		header := proxyProtocolHeader(conn.LocalAddr(), conn.RemoteAddr())
+		if _, err := io.WriteString(conn, header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+func proxyProtocolHeader(src, dst net.Addr) string {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+	family := "TCP4"
+	if s.IP.To4() == nil || d.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port)
+}
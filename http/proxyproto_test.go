@@ -0,0 +1,68 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51000},
+			&net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443},
+			"PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\n",
+		},
+		{
+			&net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			&net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			"PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, test := range tests {
+		if got := proxyProtocolHeader(test.src, test.dst); got != test.want {
+			t.Errorf("proxyProtocolHeader(%v, %v) = %q, want %q", test.src, test.dst, got, test.want)
+		}
+	}
+}
+
+func TestProxyProtocolDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	conn, err := proxyProtocolDialer(transport.NetDialer(0)).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src, dst := conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+	want := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", src.Port, dst.Port)
+	if got := <-received; got != want {
+		t.Errorf("server received %q first, want %q", got, want)
+	}
+}
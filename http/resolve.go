@@ -0,0 +1,29 @@
+package http
+
+import (
+	"net"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+)
+
+// resolveOverride maps a host name to the address connections to it are
+// made to, like curl's --resolve.
+type resolveOverride struct {
+	Host    string `config:"host" validate:"required"`
+	Address string `config:"address" validate:"required"`
+}
+
+// resolvingDialer dials the address configured for a host name instead of
+// resolving it. Dialers wrapping it, such as the TLS dialer, still see the
+// host name, so it is used for SNI and certificate verification.
+func resolvingDialer(d transport.Dialer, addresses map[string]string) transport.Dialer {
+	return transport.DialerFunc(func(network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err == nil {
+			if ip, ok := addresses[host]; ok {
+				address = net.JoinHostPort(ip, port)
+			}
+		}
+		return d.Dial(network, address)
+	})
+}
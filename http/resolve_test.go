@@ -0,0 +1,28 @@
+package http
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+)
+
+func TestResolvingDialer(t *testing.T) {
+	var dialed string
+	d := resolvingDialer(transport.DialerFunc(func(network, address string) (net.Conn, error) {
+		dialed = address
+		return nil, errors.New("not dialing")
+	}), map[string]string{"ingest.internal": "10.0.0.5", "v6.internal": "2001:db8::5"})
+
+	for address, want := range map[string]string{
+		"ingest.internal:443": "10.0.0.5:443",
+		"v6.internal:8080":    "[2001:db8::5]:8080",
+		"other.internal:443":  "other.internal:443",
+	} {
+		d.Dial("tcp", address)
+		if dialed != want {
+			t.Errorf("dialing %s dialed %s, want %s", address, dialed, want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// decodeBody returns a reader for the response body, decompressing it
+// according to its Content-Encoding. Bodies the transport decompressed
+// already have the header removed.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// deflate should be zlib wrapped, but some servers send raw deflate
+		r := bufio.NewReader(resp.Body)
+		if header, err := r.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(r)
+		}
+		return flate.NewReader(r), nil
+	case "br":
+		return brotli.NewReader(resp.Body), nil
+	}
+	return nil, fmt.Errorf("unsupported response Content-Encoding: %s", encoding)
+}
+
+// readStream reads a streamed response, such as a text/event-stream, line by
+// line until the line starting with streamMarker and checks the value
+// following the marker. The rest of the stream is not read, as the server
+// may keep it open.
+func (conn *Connection) readStream(body io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		if !strings.HasPrefix(line, conn.streamMarker) {
+			continue
+		}
+		if len(conn.streamSuccess) == 0 {
+			return buf.Bytes(), nil
+		}
+		value := strings.TrimSpace(line[len(conn.streamMarker):])
+		for _, success := range conn.streamSuccess {
+			if value == success {
+				return buf.Bytes(), nil
+			}
+		}
+		return buf.Bytes(), fmt.Errorf("%w: %s", ErrStreamStatus, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return buf.Bytes(), err
+	}
+	return buf.Bytes(), fmt.Errorf("response stream ended before %q: %w", conn.streamMarker, io.ErrUnexpectedEOF)
+}
+
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// rejectedCount returns how many of the events of a batch the response body
+// reports as rejected, by rejectedField or else as events minus the value of
+// acceptedField. ok is false if the body doesn't report a count.
+func (client *Client) rejectedCount(body []byte, events int) (rejected int, ok bool) {
+	var doc mapstr.M
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return 0, false
+	}
+	if client.rejectedField != "" {
+		value, err := doc.GetValue(client.rejectedField)
+		if err != nil {
+			return 0, false
+		}
+		n, ok := toFloat(value)
+		return int(n), ok
+	}
+	value, err := doc.GetValue(client.acceptedField)
+	if err != nil {
+		return 0, false
+	}
+	n, ok := toFloat(value)
+	return events - int(n), ok
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// transformScript is a compiled expr (github.com/antonmedv/expr) expression
+// evaluated per event, with the event fields as `event` and its time as
+// `timestamp`. It must return an object, which replaces the event fields.
+type transformScript struct {
+	program *vm.Program
+}
+
+func newTransformScript(source string) (*transformScript, error) {
+	env := map[string]interface{}{
+		"event":     map[string]interface{}{},
+		"timestamp": time.Time{},
+	}
+	program, err := expr.Compile(source, expr.Env(env))
+	if err != nil {
+		return nil, fmt.Errorf("invalid transform_script: %v", err)
+	}
+	return &transformScript{program: program}, nil
+}
+
+func (s *transformScript) run(event *beat.Event) (mapstr.M, error) {
+	env := map[string]interface{}{
+		"event":     map[string]interface{}(event.Fields.Clone()),
+		"timestamp": event.Timestamp,
+	}
+	result, err := expr.Run(s.program, env)
+	if err != nil {
+		return nil, err
+	}
+	switch fields := result.(type) {
+	case map[string]interface{}:
+		return fields, nil
+	case mapstr.M:
+		return fields, nil
+	}
+	return nil, fmt.Errorf("transform_script returned %T instead of an object", result)
+}
+
+// scriptFields returns the result of the transform script for event, or
+// the fields of event if the script failed. It is applied by encodeEvent,
+// so the event itself is not modified.
+func (client *Client) scriptFields(event *beat.Event) mapstr.M {
+	fields, err := client.script.run(event)
+	if err != nil {
+		logger.Debugf("Sending event unchanged, transform_script failed: %v", err)
+		return event.Fields
+	}
+	return fields
+}
+
+// scriptEvents drops the events the transform script fails on with
+// on_script_failure drop. The script result is applied when the event is
+// encoded.
+func (client *Client) scriptEvents(data []publisher.Event) []publisher.Event {
+	if client.script == nil || !client.scriptDrop {
+		return data
+	}
+	kept := make([]publisher.Event, 0, len(data))
+	for i := range data {
+		if _, err := client.script.run(&data[i].Content); err != nil {
+			logger.Debugf("Dropping event, transform_script failed: %v", err)
+			continue
+		}
+		kept = append(kept, data[i])
+	}
+	if dropped := len(data) - len(kept); dropped > 0 {
+		client.dropEvents("transform_script", dropped)
+	}
+	return kept
+}
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func newTestScript(t *testing.T, source string) *transformScript {
+	t.Helper()
+	script, err := newTransformScript(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestTransformScript(t *testing.T) {
+	doer := &fakeDoer{}
+	s := ClientSettings{BatchPublish: true, script: newTestScript(t, `{"msg": event.message}`)}
+	client := newTestClient(t, s, doer)
+	events := testEvents(2)
+	client.Publish(context.Background(), &fakeBatch{events: events})
+
+	if doer.count() != 1 || !strings.Contains(doer.bodies[0], `"msg":"event 1"`) {
+		t.Fatalf("script result not sent: %q", doer.bodies)
+	}
+	for i := range events {
+		if _, err := events[i].Content.Fields.GetValue("msg"); err == nil {
+			t.Errorf("event %d was modified: %v", i, events[i].Content.Fields)
+		}
+	}
+}
+
+func TestTransformScriptFailure(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		doer := &fakeDoer{}
+		observer := &fakeObserver{}
+		s := ClientSettings{BatchPublish: true, Observer: observer, ScriptDrop: drop, script: newTestScript(t, `"text"`)}
+		client := newTestClient(t, s, doer)
+		batch := &fakeBatch{events: testEvents(2)}
+		client.Publish(context.Background(), batch)
+
+		if drop {
+			if doer.count() != 0 || observer.dropped != 2 {
+				t.Errorf("drop: %d requests, %d dropped, want 0, 2", doer.count(), observer.dropped)
+			}
+			continue
+		}
+		if doer.count() != 1 || !strings.Contains(doer.bodies[0], `"message":"event 1"`) {
+			t.Errorf("events not sent unchanged: %q", doer.bodies)
+		}
+	}
+}
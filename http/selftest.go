@@ -0,0 +1,56 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+)
+
+type selfTestConfig struct {
+	Enabled bool   `config:"enabled"`
+	Body    string `config:"body"`
+	// Require is "any" or "all" for the number of hosts that must accept
+	// the test event for the output to start, or "none" to only log.
+	Require string `config:"require"`
+}
+
+// runSelfTest sends the test body to the host of each client before any
+// events are published, and fails unless as many hosts as required
+// accepted it.
+func runSelfTest(c selfTestConfig, clients []*Client) error {
+	var failures []string
+	for _, client := range clients {
+		if err := client.selfTest(c.Body); err != nil {
+			logger.Errorf("Self test of %s failed: %v", client.URL, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", client.URL, err))
+			continue
+		}
+		logger.Infof("Self test of %s succeeded", client.URL)
+	}
+	failed := len(failures)
+	switch {
+	case c.Require == "any" && failed == len(clients), c.Require == "all" && failed > 0:
+		return fmt.Errorf("self test failed on %d of %d hosts: %s", failed, len(clients), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (client *Client) selfTest(body string) error {
+	if client.session != nil {
+		if err := client.runBootstrap(); err != nil {
+			return err
+		}
+	}
+	if client.ws != nil {
+		// frames are not answered, sending the body is all there is to check
+		_, err := client.ws.send([][]byte{[]byte(body)})
+		return err
+	}
+	status, _, err := client.request(client.method, client.URL, client.ContentType, client.params, rawBody(body), client.headers)
+	if err != nil {
+		return err
+	}
+	if client.classify(status, err) != statusSuccess {
+		return fmt.Errorf("status %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package http
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSelfTestWebSocket(t *testing.T) {
+	doer := &fakeDoer{}
+	client := newTestClient(t, ClientSettings{URL: "ws://localhost:8080/ingest"}, doer)
+	dialed := errors.New("dialed")
+	var address string
+	client.ws.dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		address = addr
+		return nil, dialed
+	}
+
+	if err := client.selfTest(`{"message":"test"}`); err != dialed {
+		t.Errorf("selfTest() = %v, want the WebSocket dial error", err)
+	}
+	if address != "localhost:8080" {
+		t.Errorf("dialed %q, want localhost:8080", address)
+	}
+	if doer.count() != 0 {
+		t.Errorf("sent %d HTTP requests, want none", doer.count())
+	}
+}
@@ -0,0 +1,76 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandSigner produces request signatures by running an external command
+// with the request body on stdin. The command's stdout is used as signature.
+type commandSigner struct {
+	command string
+	args    []string
+	header  string
+	ttl     time.Duration
+	timeout time.Duration
+
+	mu        sync.Mutex
+	signature string
+	bodySum   [sha256.Size]byte
+	expires   time.Time
+}
+
+func newCommandSigner(command string, args []string, header string, ttl, timeout time.Duration) *commandSigner {
+	return &commandSigner{
+		command: command,
+		args:    args,
+		header:  header,
+		ttl:     ttl,
+		timeout: timeout,
+	}
+}
+
+// Sign returns the signature for body. The signature of the previous body
+// is reused for the same body until its TTL has expired.
+func (s *commandSigner) Sign(body []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum := sha256.Sum256(body)
+	if s.signature != "" && sum == s.bodySum && time.Now().Before(s.expires) {
+		return s.signature, nil
+	}
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, s.args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("signing command %s failed: %v (%s)", s.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	signature := strings.TrimSpace(string(out))
+	if signature == "" {
+		return "", fmt.Errorf("signing command %s returned an empty signature", s.command)
+	}
+	if s.ttl > 0 {
+		s.signature = signature
+		s.bodySum = sum
+		s.expires = time.Now().Add(s.ttl)
+	}
+	return signature, nil
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignerCachesPerBody(t *testing.T) {
+	// the signature is the body itself, so it changes with the body
+	signer := newCommandSigner("cat", nil, "X-Signature", time.Minute, time.Second)
+	for _, body := range []string{"first", "second", "first"} {
+		signature, err := signer.Sign([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signature != body {
+			t.Errorf("signature of %q is %q", body, signature)
+		}
+	}
+}
+
+func TestSignerTimeout(t *testing.T) {
+	signer := newCommandSigner("sleep", []string{"10"}, "X-Signature", 0, 50*time.Millisecond)
+	start := time.Now()
+	if _, err := signer.Sign(nil); err == nil {
+		t.Error("Sign succeeded although the command timed out")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Sign took %v despite the timeout", took)
+	}
+}
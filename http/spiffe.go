@@ -0,0 +1,24 @@
+package http
+
+import (
+	"context"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// spiffeConfig configures fetching the client certificate from the SPIFFE
+// Workload API instead of the static tls.certificate and tls.key files.
+type spiffeConfig struct {
+	Socket  string        `config:"socket"`
+	Timeout time.Duration `config:"timeout"`
+}
+
+// newSVIDSource connects to the Workload API and waits for the first
+// X.509-SVID. The source keeps receiving rotated SVIDs in the background.
+func newSVIDSource(c spiffeConfig) (*workloadapi.X509Source, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return workloadapi.NewX509Source(ctx,
+		workloadapi.WithClientOptions(workloadapi.WithAddr(c.Socket)))
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+type statefulConfig struct {
+	// ResponseHeader or ResponseField of a JSON response body carries the
+	// value sent in RequestHeader of the next request.
+	ResponseHeader string `config:"response_header"`
+	ResponseField  string `config:"response_field"`
+	RequestHeader  string `config:"request_header"`
+}
+
+// statefulHeader replays a value taken from the last response, such as the
+// continuation or ack token of a queue API, as header of the next request.
+// Each client keeps its own state.
+type statefulHeader struct {
+	responseHeader string
+	responseField  string
+	requestHeader  string
+
+	mu    sync.Mutex
+	value string
+}
+
+func newStatefulHeader(c statefulConfig) *statefulHeader {
+	return &statefulHeader{
+		responseHeader: c.ResponseHeader,
+		responseField:  c.ResponseField,
+		requestHeader:  c.RequestHeader,
+	}
+}
+
+func (s *statefulHeader) config() statefulConfig {
+	return statefulConfig{s.responseHeader, s.responseField, s.requestHeader}
+}
+
+// capture keeps the value of a successful response. Responses without it
+// leave the previous value in place.
+func (s *statefulHeader) capture(header http.Header, body []byte) {
+	var value string
+	if s.responseHeader != "" {
+		value = header.Get(s.responseHeader)
+	} else {
+		var doc mapstr.M
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return
+		}
+		v, err := doc.GetValue(s.responseField)
+		if err != nil {
+			return
+		}
+		value = fmt.Sprint(v)
+	}
+	if value == "" {
+		return
+	}
+	s.mu.Lock()
+	s.value = value
+	s.mu.Unlock()
+}
+
+// apply sets the request header to the last captured value, if any.
+func (s *statefulHeader) apply(header http.Header) {
+	s.mu.Lock()
+	value := s.value
+	s.mu.Unlock()
+	if value != "" {
+		header.Set(s.requestHeader, value)
+	}
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestThrottle(t *testing.T) {
+	s := ClientSettings{limiter: rate.NewLimiter(1000, 2)}
+	client := newTestClient(t, s, &fakeDoer{})
+	// more events than the burst are waited for in chunks
+	if err := client.throttle(5); err != nil {
+		t.Fatalf("throttle(5) with burst 2: %v", err)
+	}
+
+	client.limiter = rate.NewLimiter(0.001, 1)
+	client.throttle(1)
+	done := make(chan error, 1)
+	go func() { done <- client.throttle(1) }()
+	client.abortRequests()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("aborted wait didn't fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not aborted")
+	}
+}
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// tlsDialOptions are the TLS options transport.TLSDialer doesn't support.
+type tlsDialOptions struct {
+	// serverName is sent as SNI and the server certificate is verified
+	// against it instead of the dialed host.
+	serverName string
+	// svids provides the client certificate.
+	svids x509svid.Source
+	// fingerprints are the allowed SHA-256 fingerprints of the server's
+	// leaf certificate, checked in addition to the regular verification.
+	fingerprints []string
+	// sessionTickets enables session resumption with tickets if true and
+	// disables tickets if false.
+	sessionTickets *bool
+}
+
+func (o tlsDialOptions) isSet() bool {
+	return o.serverName != "" || o.svids != nil || len(o.fingerprints) > 0 || o.sessionTickets != nil
+}
+
+// customTLSDialer dials TLS connections with options.
+func customTLSDialer(
+	forward transport.Dialer,
+	config *tlscommon.TLSConfig,
+	timeout time.Duration,
+	options tlsDialOptions,
+) transport.Dialer {
+	var getCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	if options.svids != nil {
+		getCertificate = tlsconfig.GetClientCertificate(options.svids)
+	}
+	// sessions are cached per dialer, so per client
+	var sessions tls.ClientSessionCache
+	if options.sessionTickets != nil && *options.sessionTickets {
+		sessions = tls.NewLRUClientSessionCache(0)
+	}
+	return transport.DialerFunc(func(network, address string) (net.Conn, error) {
+		host := options.serverName
+		if host == "" {
+			var err error
+			if host, _, err = net.SplitHostPort(address); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := forward.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig := &tls.Config{ServerName: host}
+		if config != nil {
+			tlsConfig = config.BuildModuleClientConfig(host)
+		}
+		if getCertificate != nil {
+			tlsConfig.GetClientCertificate = getCertificate
+		}
+		if options.sessionTickets != nil {
+			tlsConfig.SessionTicketsDisabled = !*options.sessionTickets
+			tlsConfig.ClientSessionCache = sessions
+		}
+		if len(options.fingerprints) > 0 {
+			verify := tlsConfig.VerifyPeerCertificate
+			tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+				if verify != nil {
+					if err := verify(rawCerts, chains); err != nil {
+						return err
+					}
+				}
+				return verifyFingerprint(rawCerts, options.fingerprints)
+			}
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(timeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	})
+}
+
+// verifyFingerprint checks the SHA-256 fingerprint of the leaf certificate
+// against the allowed fingerprints.
+func verifyFingerprint(rawCerts [][]byte, fingerprints []string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	sum := sha256.Sum256(rawCerts[0])
+	fingerprint := hex.EncodeToString(sum[:])
+	for _, allowed := range fingerprints {
+		if normalizeFingerprint(allowed) == fingerprint {
+			return nil
+		}
+	}
+	return fmt.Errorf("server certificate fingerprint %s is not allowed", fingerprint)
+}
+
+// normalizeFingerprint accepts hex fingerprints in any case, with or
+// without colons.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
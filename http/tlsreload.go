@@ -0,0 +1,95 @@
+package http
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+)
+
+// reloadingTLSDialer rebuilds its TLS dialer when any of the configured
+// certificate authority files changes on disk. Files are checked at most
+// once per interval, when a new connection is dialed.
+type reloadingTLSDialer struct {
+	forward  transport.Dialer
+	config   *tlscommon.Config
+	timeout  time.Duration
+	interval time.Duration
+
+	mu       sync.Mutex
+	dialer   transport.Dialer
+	checked  time.Time
+	modTimes map[string]time.Time
+}
+
+func newReloadingTLSDialer(
+	forward transport.Dialer,
+	config *tlscommon.Config,
+	tlsConfig *tlscommon.TLSConfig,
+	timeout, interval time.Duration,
+) *reloadingTLSDialer {
+	return &reloadingTLSDialer{
+		forward:  forward,
+		config:   config,
+		timeout:  timeout,
+		interval: interval,
+		dialer:   transport.TLSDialer(forward, tlsConfig, timeout),
+		checked:  time.Now(),
+		modTimes: caModTimes(config.CAs),
+	}
+}
+
+func (d *reloadingTLSDialer) Dial(network, address string) (net.Conn, error) {
+	return d.current().Dial(network, address)
+}
+
+func (d *reloadingTLSDialer) current() transport.Dialer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if time.Since(d.checked) < d.interval {
+		return d.dialer
+	}
+	d.checked = time.Now()
+
+	modTimes := caModTimes(d.config.CAs)
+	if sameModTimes(modTimes, d.modTimes) {
+		return d.dialer
+	}
+	tlsConfig, err := tlscommon.LoadTLSConfig(d.config)
+	if err != nil {
+		logger.Warnf("Failed to reload TLS configuration, keeping the previous one: %v", err)
+		return d.dialer
+	}
+	logger.Info("Reloaded TLS configuration after certificate authorities changed.")
+	d.dialer = transport.TLSDialer(d.forward, tlsConfig, d.timeout)
+	d.modTimes = modTimes
+	return d.dialer
+}
+
+// caModTimes returns the modification times of all certificate authorities
+// that are files. Inline PEM certificates are ignored.
+func caModTimes(cas []string) map[string]time.Time {
+	modTimes := make(map[string]time.Time, len(cas))
+	for _, ca := range cas {
+		if info, err := os.Stat(ca); err == nil {
+			modTimes[ca] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, t := range a {
+		if !t.Equal(b[file]) {
+			return false
+		}
+	}
+	return true
+}
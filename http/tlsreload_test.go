@@ -0,0 +1,104 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport"
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+)
+
+// writeTestCA writes a self-signed CA certificate to path.
+func writeTestCA(t *testing.T, path string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadingTLSDialer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestCA(t, path)
+	config := &tlscommon.Config{CAs: []string{path}}
+	tlsConfig, err := tlscommon.LoadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newReloadingTLSDialer(transport.NetDialer(time.Second), config, tlsConfig, time.Second, time.Hour)
+	loaded := d.modTimes[path]
+
+	// a changed CA is only noticed once the interval passed
+	changed := loaded.Add(time.Minute)
+	if err := os.Chtimes(path, changed, changed); err != nil {
+		t.Fatal(err)
+	}
+	d.current()
+	if !d.modTimes[path].Equal(loaded) {
+		t.Fatal("reloaded before the interval passed")
+	}
+	d.checked = time.Now().Add(-time.Hour)
+	d.current()
+	if !d.modTimes[path].Equal(changed) {
+		t.Errorf("not reloaded after the CA changed: modification time %v, want %v", d.modTimes[path], changed)
+	}
+
+	// a CA that can't be loaded keeps the previous configuration
+	if err := ioutil.WriteFile(path, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	broken := changed.Add(time.Minute)
+	if err := os.Chtimes(path, broken, broken); err != nil {
+		t.Fatal(err)
+	}
+	d.checked = time.Now().Add(-time.Hour)
+	d.current()
+	if !d.modTimes[path].Equal(changed) {
+		t.Error("reloaded an invalid CA")
+	}
+}
+
+func TestSameModTimes(t *testing.T) {
+	now := time.Now()
+	a := map[string]time.Time{"a.pem": now}
+	for _, test := range []struct {
+		b    map[string]time.Time
+		same bool
+	}{
+		{map[string]time.Time{"a.pem": now}, true},
+		{map[string]time.Time{"a.pem": now.Add(time.Second)}, false},
+		{map[string]time.Time{"b.pem": now}, false},
+		{map[string]time.Time{"a.pem": now, "b.pem": now}, false},
+	} {
+		if got := sameModTimes(a, test.b); got != test.same {
+			t.Errorf("sameModTimes(%v, %v) = %v, want %v", a, test.b, got, test.same)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+type renameField struct {
+	From string `config:"from" validate:"required"`
+	To   string `config:"to" validate:"required"`
+}
+
+// coerceField converts the value of Field to Type, one of "string", "int",
+// "float" or "bool".
+type coerceField struct {
+	Field string `config:"field" validate:"required"`
+	Type  string `config:"type" validate:"required"`
+}
+
+// withBeatMetadata returns fields extended by the shipper's identity, values
+// in fields take precedence.
+func withBeatMetadata(fields mapstr.M, info beat.Info) mapstr.M {
+	m := mapstr.M{
+		"agent": mapstr.M{
+			"hostname": info.Hostname,
+			"type":     info.Beat,
+			"version":  info.Version,
+		},
+	}
+	m.DeepUpdate(fields.Clone())
+	return m
+}
+
+// encodeEvent applies the configured event transformations and converts
+// the event to its wire representation. The original event is not modified,
+// so retries start from the unchanged event.
+func (client *Client) encodeEvent(event *beat.Event) eventRaw {
+	if !client.transformsEvents() {
+		return makeEvent(event)
+	}
+	e := *event
+	if client.script != nil {
+		e.Fields = client.scriptFields(event)
+	}
+	e.Fields = e.Fields.Clone()
+	if e.Fields == nil {
+		e.Fields = mapstr.M{}
+	}
+	e.Fields.DeepUpdate(client.addFields.Clone())
+	for _, rename := range client.renameFields {
+		value, err := e.Fields.GetValue(rename.From)
+		if err != nil {
+			continue
+		}
+		e.Fields.Delete(rename.From)
+		if _, err := e.Fields.Put(rename.To, value); err != nil {
+			logger.Debugf("Failed to rename field %s to %s: %v", rename.From, rename.To, err)
+		}
+	}
+	if len(client.coerceFields) > 0 || len(client.maskFields) > 0 {
+		// nested maps that are not mapstr.M are shared with the original
+		e.Fields = deepCopy(e.Fields).(mapstr.M)
+		client.coerce(e.Fields)
+		client.mask(e.Fields)
+	}
+	if client.flatten {
+		e.Fields = flattenFields(e.Fields, client.flattenSep, client.indexArrays)
+	}
+	if client.decimalNumbers {
+		e.Fields = decimalNumbers(e.Fields).(mapstr.M)
+	}
+	return makeEvent(&e)
+}
+
+// flattenFields returns fields with nested objects replaced by keys joined
+// with sep, so {"host": {"os": {"name": "linux"}}} becomes
+// {"host.os.name": "linux"}. With indexArrays array elements are flattened
+// too, using their index as key, otherwise arrays are kept as they are.
+func flattenFields(fields mapstr.M, sep string, indexArrays bool) mapstr.M {
+	flat := mapstr.M{}
+	for k, v := range fields {
+		flattenValue(flat, k, v, sep, indexArrays)
+	}
+	return flat
+}
+
+func flattenValue(flat mapstr.M, key string, v interface{}, sep string, indexArrays bool) {
+	var nested map[string]interface{}
+	switch v := v.(type) {
+	case mapstr.M:
+		nested = v
+	case map[string]interface{}:
+		nested = v
+	case []interface{}:
+		if indexArrays && len(v) > 0 {
+			for i, value := range v {
+				flattenValue(flat, key+sep+strconv.Itoa(i), value, sep, indexArrays)
+			}
+			return
+		}
+	}
+	if len(nested) == 0 {
+		// scalars, kept arrays and empty objects
+		flat[key] = v
+		return
+	}
+	for k, value := range nested {
+		flattenValue(flat, key+sep+k, value, sep, indexArrays)
+	}
+}
+
+func (client *Client) transformsEvents() bool {
+	return len(client.addFields) > 0 || len(client.renameFields) > 0 ||
+		len(client.coerceFields) > 0 || len(client.maskFields) > 0 ||
+		client.decimalNumbers || client.flatten || client.script != nil
+}
+
+// coerce converts the values of coerce_fields to their configured types.
+// Values that can't be converted are kept, or removed with on_coerce_failure
+// drop.
+func (client *Client) coerce(fields mapstr.M) {
+	for _, c := range client.coerceFields {
+		value, err := fields.GetValue(c.Field)
+		if err != nil {
+			continue
+		}
+		if coerced, ok := coerceValue(value, c.Type); ok {
+			fields.Put(c.Field, coerced)
+		} else if client.coerceDrop {
+			logger.Debugf("Removing field %s, %v is no %s", c.Field, value, c.Type)
+			fields.Delete(c.Field)
+		}
+	}
+}
+
+func coerceValue(value interface{}, typ string) (interface{}, bool) {
+	if n, ok := value.(json.Number); ok {
+		value = n.String()
+	}
+	switch typ {
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			return fmt.Sprint(v), true
+		case float32:
+			return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		}
+	case "int":
+		if s, ok := value.(string); ok {
+			i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			return i, err == nil
+		}
+		if f, ok := toFloat(value); ok && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f), true
+		}
+	case "float":
+		if s, ok := value.(string); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			return f, err == nil
+		}
+		return toFloat(value)
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			return b, err == nil
+		}
+	}
+	return nil, false
+}
+
+// toFloat returns numeric values as float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// mask replaces the values of mask_fields by "***" or, with mask_mode
+// hash, by the hex encoded SHA-256 hash of the value.
+func (client *Client) mask(fields mapstr.M) {
+	for _, field := range client.maskFields {
+		value, err := fields.GetValue(field)
+		if err != nil {
+			continue
+		}
+		masked := "***"
+		if client.maskMode == "hash" {
+			sum := sha256.Sum256([]byte(fmt.Sprint(value)))
+			masked = hex.EncodeToString(sum[:])
+		}
+		fields.Put(field, masked)
+	}
+}
+
+// deepCopy returns a copy of v that shares no maps or slices with it.
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case mapstr.M:
+		m := make(mapstr.M, len(v))
+		for k, value := range v {
+			m[k] = deepCopy(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			m[k] = deepCopy(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = deepCopy(value)
+		}
+		return s
+	}
+	return v
+}
+
+// decimalNumbers returns a copy of v with floating point numbers replaced by
+// their decimal representation, so 1e18 is encoded as 1000000000000000000
+// instead of 1e+18.
+func decimalNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		return decimalNumber(v)
+	case float32:
+		return decimalNumber(float64(v))
+	case mapstr.M:
+		m := make(mapstr.M, len(v))
+		for k, value := range v {
+			m[k] = decimalNumbers(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			m[k] = decimalNumbers(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = decimalNumbers(value)
+		}
+		return s
+	case []float64:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = decimalNumber(value)
+		}
+		return s
+	}
+	return v
+}
+
+func decimalNumber(f float64) interface{} {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		// not representable in JSON either way
+		return f
+	}
+	return json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+}
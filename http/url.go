@@ -1,23 +1,28 @@
 package http
 
 import (
-	"github.com/elastic/beats/v7/libbeat/common"
+	"fmt"
+	"net"
 	"net/url"
+	"regexp"
 	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
 )
 
-func addToURL(urlStr string, params map[string]string) string {
+// addToURL appends the percent-encoded params to urlStr, keeping a query
+// urlStr already has. Keys with several values are repeated.
+func addToURL(urlStr string, params url.Values) string {
 	if strings.HasSuffix(urlStr, "/") {
 		urlStr = strings.TrimSuffix(urlStr, "/")
 	}
 	if len(params) == 0 {
 		return urlStr
 	}
-	values := url.Values{}
-	for key, val := range params {
-		values.Add(key, val)
+	if strings.Contains(urlStr, "?") {
+		return urlStr + "&" + params.Encode()
 	}
-	return common.EncodeURLParams(urlStr, values)
+	return urlStr + "?" + params.Encode()
 }
 
 func parseProxyURL(raw string) (*url.URL, error) {
@@ -32,3 +37,94 @@ func parseProxyURL(raw string) (*url.URL, error) {
 	// see if that parses correctly.
 	return url.Parse("http://" + raw)
 }
+
+// normalizeHost prepares a hosts entry for common.MakeURL. IPv6 literals are
+// bracketed, "2001:db8::1" becomes "[2001:db8::1]", with or without scheme,
+// and bracketed hosts get the protocol as scheme if they have none: without
+// one, "[2001:db8::1]:8080" doesn't parse as URL.
+func normalizeHost(protocol, host string) string {
+	scheme, rest := "", host
+	if i := strings.Index(host, "://"); i >= 0 {
+		scheme, rest = host[:i], host[i+len("://"):]
+	}
+	addr, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		addr, path = rest[:i], rest[i:]
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		addr = "[" + addr + "]"
+	}
+	if !strings.HasPrefix(addr, "[") {
+		return host
+	}
+	if scheme == "" {
+		scheme = protocol
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + addr + path
+}
+
+// joinURLPath appends the escaped path to the path of urlStr, keeping the
+// query of urlStr.
+func joinURLPath(urlStr, path string) string {
+	if path == "" {
+		return urlStr
+	}
+	path = "/" + strings.TrimPrefix(path, "/")
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		// left to the request to report
+		return strings.TrimSuffix(urlStr, "/") + path
+	}
+	joined := strings.TrimSuffix(u.EscapedPath(), "/") + path
+	unescaped, err := url.PathUnescape(joined)
+	if err != nil {
+		return strings.TrimSuffix(urlStr, "/") + path
+	}
+	u.Path, u.RawPath = unescaped, joined
+	return u.String()
+}
+
+// dataStreamName builds the "<type>-<dataset>-<namespace>" data stream name
+// from the event's data_stream fields, using the Elasticsearch defaults for
+// missing components.
+func dataStreamName(event *beat.Event) string {
+	get := func(key, def string) string {
+		v, err := event.GetValue("data_stream." + key)
+		if err != nil {
+			return def
+		}
+		if s, ok := v.(string); ok && s != "" {
+			return s
+		}
+		return def
+	}
+	name := get("type", "logs") + "-" + get("dataset", "generic") + "-" + get("namespace", "default")
+	return url.PathEscape(name)
+}
+
+var pathFieldPattern = regexp.MustCompile(`%\{\[([^\]]+)\]\}`)
+
+// pathTemplate expands %{[field]} references in a path with the URL-escaped
+// values of the event fields.
+type pathTemplate struct {
+	template  string
+	missing   string
+	lowercase bool
+}
+
+func (t *pathTemplate) Expand(event *beat.Event) string {
+	return pathFieldPattern.ReplaceAllStringFunc(t.template, func(ref string) string {
+		field := pathFieldPattern.FindStringSubmatch(ref)[1]
+		value := t.missing
+		if v, err := event.GetValue(field); err == nil && v != nil {
+			value = fmt.Sprint(v)
+		}
+		if t.lowercase {
+			value = strings.ToLower(value)
+		}
+		return url.PathEscape(value)
+	})
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func TestHostURL(t *testing.T) {
+	tests := []struct {
+		protocol, host, want string
+	}{
+		{"", "localhost:9200", "http://localhost:9200/ingest"},
+		{"", "[2001:db8::1]:8080", "http://[2001:db8::1]:8080/ingest"},
+		{"", "[2001:db8::1]", "http://[2001:db8::1]:80/ingest"},
+		{"", "2001:db8::1", "http://[2001:db8::1]:80/ingest"},
+		{"https", "[2001:db8::1]:8080", "https://[2001:db8::1]:8080/ingest"},
+		{"https", "2001:db8::1", "https://[2001:db8::1]:80/ingest"},
+		{"", "https://[2001:db8::1]:8080", "https://[2001:db8::1]:8080/ingest"},
+		{"", "https://[2001:db8::1]", "https://[2001:db8::1]:80/ingest"},
+		{"", "https://2001:db8::1", "https://[2001:db8::1]:80/ingest"},
+		{"", "https://2001:db8::1/other", "https://[2001:db8::1]:80/other"},
+		{"http", "https://[2001:db8::1]:8080", "https://[2001:db8::1]:8080/ingest"},
+	}
+	for _, test := range tests {
+		// as called by MakeHTTP
+		got, err := common.MakeURL(test.protocol, "/ingest", normalizeHost(test.protocol, test.host), 80)
+		if err != nil {
+			t.Errorf("%q with protocol %q: %v", test.host, test.protocol, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q with protocol %q: got %s, want %s", test.host, test.protocol, got, test.want)
+		}
+	}
+}
+
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		base, path, want string
+	}{
+		{"http://h:80/ingest", "", "http://h:80/ingest"},
+		{"http://h:80/ingest/", "/bulk", "http://h:80/ingest/bulk"},
+		{"http://h:80/ingest?tag=a&tag=b", "bulk", "http://h:80/ingest/bulk?tag=a&tag=b"},
+		{"http://h:80/ingest?q=x%26y+z", "bulk", "http://h:80/ingest/bulk?q=x%26y+z"},
+		{"http://h:80/?q=1", "bulk", "http://h:80/bulk?q=1"},
+		{"http://h:80/ingest", url.PathEscape("a/b c"), "http://h:80/ingest/a%2Fb%20c"},
+	}
+	for _, test := range tests {
+		if got := joinURLPath(test.base, test.path); got != test.want {
+			t.Errorf("joinURLPath(%q, %q) = %q, want %q", test.base, test.path, got, test.want)
+		}
+	}
+}
+
+func TestAddToURL(t *testing.T) {
+	params := url.Values{"tag": {"c d", "e&f"}}
+	tests := []struct {
+		base, want string
+	}{
+		{"http://h:80/ingest", "http://h:80/ingest?tag=c+d&tag=e%26f"},
+		{"http://h:80/ingest/", "http://h:80/ingest?tag=c+d&tag=e%26f"},
+		{"http://h:80/ingest?tag=a&tag=b", "http://h:80/ingest?tag=a&tag=b&tag=c+d&tag=e%26f"},
+	}
+	for _, test := range tests {
+		got := addToURL(joinURLPath(test.base, ""), params)
+		if got != test.want {
+			t.Errorf("addToURL(%q) = %q, want %q", test.base, got, test.want)
+		}
+		// the query must survive joining a path as well
+		u, err := url.Parse(addToURL(joinURLPath(test.base, "bulk"), params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags := u.Query()["tag"]; len(tags) < 2 || tags[len(tags)-2] != "c d" || tags[len(tags)-1] != "e&f" {
+			t.Errorf("tags of %s = %q", u, tags)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/elastic-agent-libs/transport"
+	"github.com/gorilla/websocket"
+)
+
+// wsStream pushes events to a WebSocket endpoint, one JSON text frame per
+// event. The connection is opened on first use and again after it failed,
+// events that could not be written are retried with the output's backoff.
+type wsStream struct {
+	url     string
+	dialer  *websocket.Dialer
+	timeout time.Duration
+	// header returns the headers of the opening handshake
+	header func() (http.Header, error)
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func isWebSocketURL(urlStr string) bool {
+	return strings.HasPrefix(urlStr, "ws://") || strings.HasPrefix(urlStr, "wss://")
+}
+
+// newWSStream creates a stream to urlStr, dialing connections like the
+// HTTP transport does.
+func newWSStream(
+	urlStr string,
+	dialer, tlsDialer transport.Dialer,
+	proxy func(*http.Request) (*url.URL, error),
+	timeout time.Duration,
+) *wsStream {
+	wsDialer := &websocket.Dialer{
+		NetDial: dialer.Dial,
+		NetDialTLSContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return tlsDialer.Dial(network, addr)
+		},
+		Proxy:            proxy,
+		HandshakeTimeout: timeout,
+	}
+	return &wsStream{url: urlStr, dialer: wsDialer, timeout: timeout}
+}
+
+// send writes frames in order and returns how many were written. The
+// connection is closed on failure, so the next send reconnects.
+func (s *wsStream) send(frames [][]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return 0, err
+		}
+	}
+	for i, frame := range frames {
+		if s.timeout > 0 {
+			s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		}
+		if err := s.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return i, err
+		}
+		bytesSentTotal.Add(int64(len(frame)))
+	}
+	return len(frames), nil
+}
+
+func (s *wsStream) dial() error {
+	header, err := s.header()
+	if err != nil {
+		return err
+	}
+	conn, resp, err := s.dialer.Dial(s.url, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("websocket handshake with %s failed with %s: %v", s.url, resp.Status, err)
+		}
+		return err
+	}
+	logger.Debugf("Opened WebSocket connection to %s", s.url)
+	s.conn = conn
+	go discardMessages(conn)
+	return nil
+}
+
+// discardMessages reads and drops the messages sent by the server, so
+// control frames such as pings and close are handled. It returns once the
+// connection is closed.
+func discardMessages(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// close sends a close frame and closes the connection, if open.
+func (s *wsStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	s.conn.Close()
+	s.conn = nil
+}
+
+// handshakeHeader returns the headers and credentials sent with each
+// request, for the opening handshake of a WebSocket connection.
+func (conn *Connection) handshakeHeader(headers map[string]string) (http.Header, error) {
+	req := &http.Request{Header: http.Header{}}
+	conn.addHeaders(req, headers)
+	if err := conn.addBearerToken(req.Header); err != nil {
+		return nil, err
+	}
+	return req.Header, nil
+}
+
+// publishFrames sends data over the client's WebSocket connection. It
+// returns the events that were not written, the server doesn't acknowledge
+// frames.
+func (client *Client) publishFrames(data []publisher.Event) ([]publisher.Event, error) {
+	frames := make([][]byte, 0, len(data))
+	events := make([]publisher.Event, 0, len(data))
+	for i := range data {
+		frame, err := json.Marshal(client.encodeEvent(&data[i].Content))
+		if err != nil {
+			// don't retry unencodable values
+			client.dropEvents("encode", 1)
+			continue
+		}
+		frames = append(frames, frame)
+		events = append(events, data[i])
+	}
+	n, err := client.ws.send(frames)
+	if err != nil {
+		logger.Warnf("Failed to send %d events over WebSocket: %v", len(events)-n, err)
+		return events[n:], err
+	}
+	client.acked(len(events))
+	return nil, nil
+}